@@ -0,0 +1,27 @@
+package qsocket
+
+// Addr represents the address of a QSocket peer.
+// Peers are addressed by their role and the connection secret rather than
+// network endpoints, the `ID` is a short non-reversible fingerprint of the
+// relay UID so addresses can be logged safely.
+type Addr struct {
+	Type SocketType
+	ID   string
+}
+
+func newAddr(sType SocketType, keys *secretKeys) *Addr {
+	return &Addr{
+		Type: sType,
+		ID:   keys.addrID,
+	}
+}
+
+// Network returns the address's network name, "qsocket".
+func (a *Addr) Network() string {
+	return "qsocket"
+}
+
+// String returns the string form of the address.
+func (a *Addr) String() string {
+	return a.Type.String() + "/" + a.ID
+}
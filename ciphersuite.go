@@ -0,0 +1,97 @@
+package qsocket
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"runtime"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// E2E cipher suite names.
+const (
+	// CIPHER_SUITE_AES_256_GCM is AES-256 in GCM mode, fast on CPUs with AES instructions.
+	CIPHER_SUITE_AES_256_GCM = "aes-256-gcm"
+	// CIPHER_SUITE_CHACHA20_POLY1305 is ChaCha20-Poly1305 (RFC 8439), fast without AES instructions.
+	CIPHER_SUITE_CHACHA20_POLY1305 = "chacha20-poly1305"
+	// CIPHER_SUITE_XCHACHA20_POLY1305 is ChaCha20-Poly1305 with extended 192 bit nonces.
+	CIPHER_SUITE_XCHACHA20_POLY1305 = "xchacha20-poly1305"
+)
+
+var (
+	ErrNoCommonCipherSuite    = errors.New("No common cipher suite with peer.")
+	ErrUnsupportedCipherSuite = errors.New("Unsupported cipher suite.")
+)
+
+// DefaultCipherSuites is the default cipher suite preference order,
+// AES-256-GCM is preferred only if the CPU has hardware support for it.
+var DefaultCipherSuites = defaultCipherSuites()
+
+func defaultCipherSuites() []string {
+	if hasAESGCMHardwareSupport() {
+		return []string{
+			CIPHER_SUITE_AES_256_GCM,
+			CIPHER_SUITE_CHACHA20_POLY1305,
+			CIPHER_SUITE_XCHACHA20_POLY1305,
+		}
+	}
+	return []string{
+		CIPHER_SUITE_CHACHA20_POLY1305,
+		CIPHER_SUITE_XCHACHA20_POLY1305,
+		CIPHER_SUITE_AES_256_GCM,
+	}
+}
+
+// hasAESGCMHardwareSupport checks the CPU features used by the AES-GCM assembly implementations.
+func hasAESGCMHardwareSupport() bool {
+	switch runtime.GOARCH {
+	case "amd64":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	default:
+		return false
+	}
+}
+
+// newAEAD creates the AEAD of the given cipher suite with a 256 bit key.
+func newAEAD(suite string, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case CIPHER_SUITE_AES_256_GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CIPHER_SUITE_CHACHA20_POLY1305:
+		return chacha20poly1305.New(key)
+	case CIPHER_SUITE_XCHACHA20_POLY1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, ErrUnsupportedCipherSuite
+	}
+}
+
+// validCipherSuite checks if the given cipher suite is supported.
+func validCipherSuite(suite string) bool {
+	switch suite {
+	case CIPHER_SUITE_AES_256_GCM,
+		CIPHER_SUITE_CHACHA20_POLY1305,
+		CIPHER_SUITE_XCHACHA20_POLY1305:
+		return true
+	default:
+		return false
+	}
+}
+
+// CipherSuite returns the name of the negotiated E2E cipher suite,
+// or an empty string if no key exchange is performed yet.
+func (qs *QSocket) CipherSuite() string {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+	return qs.cipherSuite
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/qsocket/qsocket-go/relay"
+)
+
+func main() {
+	addr := flag.String("addr", ":80", "plain TCP listen address (empty to disable)")
+	tlsAddr := flag.String("tls-addr", ":443", "TLS listen address (empty to disable)")
+	certFile := flag.String("cert", "", "TLS certificate file")
+	keyFile := flag.String("key", "", "TLS private key file")
+	verbose := flag.Bool("v", false, "verbose logging")
+	flag.Parse()
+
+	srv := &relay.Server{}
+	if *verbose {
+		srv.Logger = log.New(os.Stderr, "[qsrn-relay] ", log.LstdFlags)
+	}
+
+	errs := make(chan error, 2)
+	listeners := 0
+	if *addr != "" {
+		listeners++
+		go func() { errs <- srv.ListenAndServe(*addr) }()
+	}
+	if *tlsAddr != "" && *certFile != "" && *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			fmt.Printf("[-] Failed loading TLS certificate: %s\n", err)
+			os.Exit(1)
+		}
+		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		listeners++
+		go func() { errs <- srv.ListenAndServeTLS(*tlsAddr, config) }()
+	}
+	if listeners == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	fmt.Printf("[-] Relay stopped: %s\n", <-errs)
+	srv.Close()
+	os.Exit(1)
+}
@@ -0,0 +1,348 @@
+package qsocket
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultKeyExchangeTimeout is the default time limit for the E2E key exchange.
+	DefaultKeyExchangeTimeout = 30 * time.Second
+	// DefaultRekeyBytes is the default amount of data encrypted under a single E2E key.
+	DefaultRekeyBytes = 1 << 30
+	// DefaultRekeyInterval is the default lifetime of a single E2E key.
+	DefaultRekeyInterval = time.Hour
+)
+
+var (
+	ErrNilConfig          = errors.New("Socket config is nil.")
+	ErrInvalidGateAddress = errors.New("Invalid QSRN gate address.")
+	ErrInvalidGatePort    = errors.New("Invalid QSRN gate port.")
+	ErrInvalidTimeout     = errors.New("Invalid timeout value.")
+	ErrInvalidMaxConns    = errors.New("Invalid max connections value.")
+	ErrInvalidRekeyLimit  = errors.New("Invalid E2E rekey limit.")
+	ErrInvalidUIDVersion  = errors.New("Invalid UID version.")
+)
+
+// Logger is the minimal logging interface used by QSocket,
+// it is satisfied by the standard `*log.Logger`.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// A Config structure describes a QSocket declaratively.
+// It can be loaded from a service configuration file and passed to
+// NewSocketWithConfig, all values are validated before the socket is created.
+type Config struct {
+	// Gate is the host name (or IP address) of the QSRN gate.
+	Gate string `json:"gate"`
+	// Port is the gate port used for plain TCP connections.
+	Port int `json:"port"`
+	// TLSPort is the gate port used for TLS connections.
+	TLSPort int `json:"tls_port"`
+	// TorGate is the onion address of the gate used in Tor mode, defaults to `QSRN_TOR_GATE`.
+	TorGate string `json:"tor_gate"`
+	// Tor enables reaching the gate over Tor, nil means Tor is not used.
+	Tor *TorConfig `json:"tor"`
+	// ServerName overrides the TLS SNI value, defaults to Gate.
+	ServerName string `json:"server_name"`
+	// Host overrides the `Host` header sent during the knock sequence, defaults to Gate.
+	Host string `json:"host"`
+	// TLS enables TLS on the relay connection of sockets dialed by Listen and
+	// NewResilientSocket. Dial and DialContext take the TLS mode as an argument,
+	// pass this value to them for declarative configs.
+	TLS bool `json:"tls"`
+	// Proxy is the URL of the proxy used for reaching the gate, `socks5://`, `socks5h://`,
+	// `http://` and `https://` URLs with credentials are supported. A plain `host:port`
+	// address is a SOCKS5 proxy.
+	Proxy string `json:"proxy"`
+	// ProxyHeader contains extra headers sent with the CONNECT request of HTTP proxies,
+	// e.g. a precomputed `Proxy-Authorization` header.
+	ProxyHeader http.Header `json:"proxy_header"`
+	// ProxyAuthenticator answers the authentication challenges of the HTTP proxy
+	// set by Proxy or found in the environment, e.g. for NTLM authentication.
+	ProxyAuthenticator ProxyAuthenticator `json:"-"`
+	// ProxyChain is a chain of proxies used for reaching the gate, the first hop is dialed
+	// directly and every following hop is reached through the previous one.
+	// It can not be used together with Proxy.
+	ProxyChain []ProxyHop `json:"proxy_chain"`
+	// ProxyFromEnvironment uses the proxy of the HTTPS_PROXY or ALL_PROXY environment
+	// variables when Proxy and ProxyChain are empty, unless the gate is excluded by NO_PROXY.
+	// It is disabled by default, so the environment never changes where sockets connect.
+	ProxyFromEnvironment bool `json:"proxy_from_environment"`
+	// WebSocket enables genuine RFC 6455 framing after the protocol switch,
+	// for passing through CDNs and proxies that inspect websocket traffic.
+	WebSocket bool `json:"websocket"`
+	// WebSocketPingInterval is the interval of websocket keepalive pings, zero disables pings.
+	WebSocketPingInterval time.Duration `json:"websocket_ping_interval"`
+	// E2E enables end-to-end encryption between the peers.
+	E2E bool `json:"e2e"`
+	// UIDVersion selects the derivation of the relay UID and the PAKE secret, zero means DefaultUIDVersion.
+	// UID_V1 is only for compatibility with old relays and peers, it allows offline attacks on the secret.
+	UIDVersion int `json:"uid_version"`
+	// KeyExchanges lists the E2E key exchanges in preference order, nil means DefaultKeyExchanges.
+	// The first key exchange of the client that the server also supports is used.
+	KeyExchanges []string `json:"key_exchanges"`
+	// CipherSuites lists the E2E cipher suites in preference order, nil means DefaultCipherSuites.
+	CipherSuites []string `json:"cipher_suites"`
+	// RekeyBytes is the amount of data encrypted under a single E2E key before
+	// the key is rotated, zero means DefaultRekeyBytes.
+	RekeyBytes int64 `json:"rekey_bytes"`
+	// RekeyInterval is the max lifetime of a single E2E key, zero means DefaultRekeyInterval.
+	RekeyInterval time.Duration `json:"rekey_interval"`
+	// CertFingerprint is the hex encoded SHA256 fingerprint of the gate TLS certificate.
+	CertFingerprint string `json:"cert_fingerprint"`
+	// TLSVerify selects the verification of the gate TLS certificate, one of the TLS_VERIFY_* modes.
+	// The default mode pins the certificate if CertFingerprint is set, otherwise it verifies the
+	// certificate chain like TLS_VERIFY_CA. TLS_VERIFY_NONE disables the verification.
+	TLSVerify string `json:"tls_verify"`
+	// RootCAFile is the PEM encoded root CA file used by the TLS_VERIFY_CA mode,
+	// the RootCAs of TLSConfig (or the system pool) are used if empty.
+	RootCAFile string `json:"root_ca_file"`
+	// TLSConfig is the base TLS config of the gate connection, e.g. for ALPN, TLS versions
+	// or cipher suites. Its ServerName overrides the ServerName above, the client certificates
+	// above override its own. Certificate verification is controlled by TLSVerify.
+	TLSConfig *tls.Config `json:"-"`
+	// ClientCertFile and ClientKeyFile are the PEM encoded certificate and key files
+	// presented to gates that request client authentication (mTLS).
+	ClientCertFile string `json:"client_cert_file"`
+	ClientKeyFile  string `json:"client_key_file"`
+	// ClientCertificates are the certificates presented to gates that request
+	// client authentication, the certificate of ClientCertFile is set here on socket creation.
+	ClientCertificates []tls.Certificate `json:"-"`
+	// GetClientCertificate returns the client certificate when the gate requests one,
+	// it takes precedence over ClientCertificates. (see tls.Config)
+	GetClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error) `json:"-"`
+	// DialTimeout bounds the TCP (or proxy) connect, zero means no timeout.
+	DialTimeout time.Duration `json:"dial_timeout"`
+	// HandshakeTimeout bounds the whole dial sequence including TLS, knock and SRP, zero means no timeout.
+	HandshakeTimeout time.Duration `json:"handshake_timeout"`
+	// KeyExchangeTimeout bounds the E2E key exchange after the peers are paired,
+	// zero means DefaultKeyExchangeTimeout.
+	KeyExchangeTimeout time.Duration `json:"key_exchange_timeout"`
+	// UserAgent overrides the user agent sent during the knock sequence.
+	UserAgent string `json:"user_agent"`
+	// MaxConns bounds the number of concurrently accepted connections of a Listener,
+	// zero means DefaultMaxConns.
+	MaxConns int `json:"max_conns"`
+	// Reconnect configures the reconnect behaviour of ResilientSocket, nil means DefaultReconnectConfig.
+	Reconnect *ReconnectConfig `json:"reconnect"`
+	// Logger receives debug messages, nil disables logging.
+	Logger Logger `json:"-"`
+}
+
+// DefaultConfig returns the default socket configuration for the public QSRN gate.
+func DefaultConfig() *Config {
+	return &Config{
+		Gate:        QSRN_GATE,
+		Port:        QSRN_GATE_PORT,
+		TLSPort:     QSRN_GATE_TLS_PORT,
+		TorGate:     QSRN_TOR_GATE,
+		TLS:         true,
+		E2E:         true,
+		DialTimeout: 10 * time.Second,
+	}
+}
+
+// Validate checks whether the config values are valid.
+func (c *Config) Validate() error {
+	if c == nil {
+		return ErrNilConfig
+	}
+	if c.Gate == "" {
+		return ErrInvalidGateAddress
+	}
+	if !validPort(c.Port) || !validPort(c.TLSPort) {
+		return ErrInvalidGatePort
+	}
+	if c.DialTimeout < 0 ||
+		c.HandshakeTimeout < 0 ||
+		c.KeyExchangeTimeout < 0 ||
+		c.WebSocketPingInterval < 0 {
+		return ErrInvalidTimeout
+	}
+	switch c.UIDVersion {
+	case 0, UID_V1, UID_V2:
+	default:
+		return ErrInvalidUIDVersion
+	}
+	if c.RekeyBytes < 0 || c.RekeyInterval < 0 {
+		return ErrInvalidRekeyLimit
+	}
+	if c.MaxConns < 0 {
+		return ErrInvalidMaxConns
+	}
+	if c.Reconnect != nil {
+		err := c.Reconnect.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Proxy != "" {
+		_, err := parseProxyURL(c.Proxy)
+		if err != nil {
+			return err
+		}
+		if len(c.ProxyChain) > 0 {
+			return ErrProxyConflict
+		}
+	}
+	for i := range c.ProxyChain {
+		err := c.ProxyChain[i].Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Tor != nil {
+		err := c.Tor.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range c.KeyExchanges {
+		_, err := NewKeyExchange(name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, suite := range c.CipherSuites {
+		if !validCipherSuite(suite) {
+			return ErrUnsupportedCipherSuite
+		}
+	}
+	if !validTLSVerifyMode(c.TLSVerify) {
+		return ErrInvalidTLSVerifyMode
+	}
+	if c.TLSVerify == TLS_VERIFY_PIN && c.CertFingerprint == "" {
+		return ErrMissingCertFingerprint
+	}
+	if (c.ClientCertFile == "") != (c.ClientKeyFile == "") {
+		return ErrInvalidClientCertificate
+	}
+	if c.CertFingerprint != "" {
+		_, err := decodeCertFingerprint(c.CertFingerprint)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clone returns a copy of the config.
+func (c *Config) Clone() *Config {
+	if c == nil {
+		return nil
+	}
+	clone := *c
+	if c.Reconnect != nil {
+		reconnect := *c.Reconnect
+		clone.Reconnect = &reconnect
+	}
+	if c.Tor != nil {
+		tor := *c.Tor
+		clone.Tor = &tor
+	}
+	if c.KeyExchanges != nil {
+		clone.KeyExchanges = append([]string{}, c.KeyExchanges...)
+	}
+	if c.CipherSuites != nil {
+		clone.CipherSuites = append([]string{}, c.CipherSuites...)
+	}
+	clone.TLSConfig = c.TLSConfig.Clone()
+	clone.ProxyHeader = c.ProxyHeader.Clone()
+	clone.ProxyChain = cloneProxyChain(c.ProxyChain)
+	if c.ClientCertificates != nil {
+		clone.ClientCertificates = append([]tls.Certificate{}, c.ClientCertificates...)
+	}
+	return &clone
+}
+
+// cipherSuites returns the E2E cipher suites in preference order.
+func (c *Config) cipherSuites() []string {
+	if c.CipherSuites != nil {
+		return c.CipherSuites
+	}
+	return DefaultCipherSuites
+}
+
+// uidVersion returns the UID derivation version.
+func (c *Config) uidVersion() int {
+	if c.UIDVersion != 0 {
+		return c.UIDVersion
+	}
+	return DefaultUIDVersion
+}
+
+// rekeyBytes returns the amount of data encrypted under a single E2E key.
+func (c *Config) rekeyBytes() int64 {
+	if c.RekeyBytes != 0 {
+		return c.RekeyBytes
+	}
+	return DefaultRekeyBytes
+}
+
+// rekeyInterval returns the max lifetime of a single E2E key.
+func (c *Config) rekeyInterval() time.Duration {
+	if c.RekeyInterval != 0 {
+		return c.RekeyInterval
+	}
+	return DefaultRekeyInterval
+}
+
+// keyExchangeTimeout returns the time limit for the E2E key exchange.
+func (c *Config) keyExchangeTimeout() time.Duration {
+	if c.KeyExchangeTimeout != 0 {
+		return c.KeyExchangeTimeout
+	}
+	return DefaultKeyExchangeTimeout
+}
+
+// reconnectConfig returns the reconnect configuration.
+func (c *Config) reconnectConfig() *ReconnectConfig {
+	if c.Reconnect != nil {
+		return c.Reconnect
+	}
+	return DefaultReconnectConfig()
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+func decodeCertFingerprint(h string) ([]byte, error) {
+	hash, err := hex.DecodeString(h)
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) != 32 {
+		return nil, ErrInvalidCertFingerprint
+	}
+	return hash, nil
+}
+
+// serverName returns the TLS SNI value for the gate connection.
+func (c *Config) serverName() string {
+	if c.ServerName != "" {
+		return c.ServerName
+	}
+	return c.Gate
+}
+
+// torGate returns the gate address used in Tor mode.
+func (c *Config) torGate() string {
+	if c.TorGate != "" {
+		return c.TorGate
+	}
+	return QSRN_TOR_GATE
+}
+
+// hostHeader returns the `Host` header value for the knock request.
+func (c *Config) hostHeader() string {
+	if c.Host != "" {
+		return c.Host
+	}
+	return c.Gate
+}
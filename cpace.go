@@ -0,0 +1,123 @@
+package qsocket
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/gtank/ristretto255"
+)
+
+// Domain separation tags of the CPace key exchange.
+const (
+	cpaceGeneratorDST = "qsocket-cpace-ristretto255-v1/generator"
+	cpaceKeyDST       = "qsocket-cpace-ristretto255-v1/key"
+)
+
+var ErrCPaceFailed = errors.New("CPace auth failed.")
+
+// cpaceKeyExchange is the balanced CPace key exchange over ristretto255.
+// Both peers derive the same generator from the secret, exchange
+// ephemeral Diffie-Hellman shares and confirm the resulting key.
+type cpaceKeyExchange struct{}
+
+func (cpaceKeyExchange) Name() string {
+	return KEY_EXCHANGE_CPACE
+}
+
+func (cpaceKeyExchange) Exchange(rw io.ReadWriter, sType SocketType, secret []byte) ([]byte, error) {
+	// The generator is a ristretto255 element hashed from the secret.
+	h := sha512.New()
+	h.Write([]byte(cpaceGeneratorDST))
+	binary.Write(h, binary.BigEndian, uint32(len(secret)))
+	h.Write(secret)
+	g := ristretto255.NewElement().FromUniformBytes(h.Sum(nil))
+
+	seed := make([]byte, 64)
+	_, err := rand.Read(seed)
+	if err != nil {
+		return nil, err
+	}
+	y := ristretto255.NewScalar().FromUniformBytes(seed)
+	share := ristretto255.NewElement().ScalarMult(y, g).Encode(nil)
+
+	// The client speaks first in every step.
+	var peerShare []byte
+	if sType == Client {
+		err = writeHandshakeFrame(rw, frameCPaceShare, share)
+		if err == nil {
+			peerShare, err = readHandshakeFrame(rw, frameCPaceShare)
+		}
+	} else {
+		peerShare, err = readHandshakeFrame(rw, frameCPaceShare)
+		if err == nil {
+			err = writeHandshakeFrame(rw, frameCPaceShare, share)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	identity := ristretto255.NewElement().Zero()
+	peer := ristretto255.NewElement()
+	if peer.Decode(peerShare) != nil || peer.Equal(identity) == 1 {
+		return nil, ErrCPaceFailed
+	}
+	k := ristretto255.NewElement().ScalarMult(y, peer)
+	if k.Equal(identity) == 1 {
+		return nil, ErrCPaceFailed
+	}
+
+	// Transcript is ordered by role for both peers.
+	transcript := append(share, peerShare...)
+	if sType != Client {
+		transcript = append(peerShare, share...)
+	}
+	h = sha512.New()
+	h.Write([]byte(cpaceKeyDST))
+	h.Write(k.Encode(nil))
+	h.Write(transcript)
+	isk := h.Sum(nil)
+	sessionKey, confirmKey := isk[:32], isk[32:]
+
+	confirm := cpaceConfirmation(confirmKey, Client, transcript)
+	expected := cpaceConfirmation(confirmKey, Server, transcript)
+	if sType != Client {
+		confirm, expected = expected, confirm
+	}
+	var peerConfirm []byte
+	if sType == Client {
+		err = writeHandshakeFrame(rw, frameCPaceConfirm, confirm)
+		if err == nil {
+			peerConfirm, err = readHandshakeFrame(rw, frameCPaceConfirm)
+		}
+	} else {
+		peerConfirm, err = readHandshakeFrame(rw, frameCPaceConfirm)
+		if err == nil && !hmac.Equal(peerConfirm, expected) {
+			// Do not confirm a peer with a wrong key.
+			return nil, ErrCPaceFailed
+		}
+		if err == nil {
+			err = writeHandshakeFrame(rw, frameCPaceConfirm, confirm)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(peerConfirm, expected) {
+		return nil, ErrCPaceFailed
+	}
+	return sessionKey, nil
+}
+
+// cpaceConfirmation calculates the key confirmation tag of the given peer.
+func cpaceConfirmation(key []byte, sType SocketType, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sType.String()))
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
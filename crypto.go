@@ -1,8 +1,8 @@
 package qsocket
 
 import (
-	"crypto/md5"
 	"crypto/sha256"
+	"io"
 
 	estream "github.com/qsocket/encrypted-stream"
 	"github.com/qsocket/go-srp"
@@ -10,30 +10,54 @@ import (
 
 const SRP_BITS = 4096
 
+// labelSrpIdentity is the domain separation label of the SRP identity.
+const labelSrpIdentity = "qsocket srp identity"
+
+// srpIdentity derives the SRP identity from the PAKE secret.
+func srpIdentity(secret []byte) []byte {
+	h := sha256.Sum256(append([]byte(labelSrpIdentity), secret...))
+	return h[:16]
+}
+
 // InitE2ECipher initiates the end-to-end encrypted stream with the given key.
+// Separate keys and nonce bases are derived for each direction with HKDF,
+// bound to the transcript of the preceding key exchange. The keys are
+// rotated periodically according to the rekey limits of the config.
+// The stream wraps the transport whatever it is (TCP, proxy, TLS or websocket),
+// since the keys are authenticated by the PAKE and never depend on TLS.
 func (qs *QSocket) InitE2ECipher(key []byte) error {
-	if qs.tlsConn == nil { // We need a valid TLS connection for initiating PAKE for E2E.
-		return ErrNoTlsConnection
+	// Sockets without a negotiated cipher suite (e.g. manual SRP) use AES-256-GCM.
+	qs.mu.RLock()
+	suite := qs.cipherSuite
+	transcriptHash := qs.transcriptHash
+	qs.mu.RUnlock()
+	if suite == "" {
+		suite = CIPHER_SUITE_AES_256_GCM
 	}
-
-	cipher, err := estream.NewAESGCMCipher(key)
+	cipher, err := newE2ECipher(qs, suite, key, transcriptHash)
 	if err != nil {
 		return err
 	}
 
+	// Directional keys make sequential nonces safe, so nonce
+	// verification protects against replay and reordering.
 	config := &estream.Config{
-		MaxChunkSize:             65535,
-		Cipher:                   cipher,
-		DisableNonceVerification: true, // This is nessesary because we don't really know who (client/server) speaks first on the relay connection.
+		MaxChunkSize:    65535,
+		Cipher:          cipher,
+		Initiator:       qs.IsClient(),
+		SequentialNonce: true,
 	}
 
 	// Create an encrypted stream from a conn.
-	encryptedConn, err := estream.NewEncryptedStream(qs.tlsConn, config)
+	transport := qs.transportConn()
+	if transport == nil {
+		return ErrSocketNotConnected
+	}
+	encryptedConn, err := estream.NewEncryptedStream(transport, config)
 	if err != nil {
 		return err
 	}
-	qs.encConn = encryptedConn
-	return nil
+	return qs.updateStack(func() { qs.encConn = encryptedConn })
 }
 
 // InitClientSRP performs the client SRP sequence for establishing PAKE.
@@ -41,15 +65,26 @@ func (qs *QSocket) InitClientSRP() ([]byte, error) {
 	if qs.IsClosed() {
 		return nil, ErrSocketNotConnected
 	}
+	return srpClient(qs, qs.secretKeys().pakeSecret)
+}
 
+// InitServerSRP performs the server SRP sequence for establishing PAKE.
+func (qs *QSocket) InitServerSRP() ([]byte, error) {
+	if qs.IsClosed() {
+		return nil, ErrSocketNotConnected
+	}
+	return srpServer(qs, qs.secretKeys().pakeSecret)
+}
+
+func srpClient(rw io.ReadWriter, secret []byte) ([]byte, error) {
 	s, err := srp.New(SRP_BITS)
 	if err != nil {
 		return nil, err
 	}
 
-	srpUser := md5.Sum([]byte(qs.secret))
-	srpPass := sha256.Sum256([]byte(qs.secret))
-	c, err := s.NewClient(srpUser[:], srpPass[:])
+	srpUser := srpIdentity(secret)
+	srpPass := sha256.Sum256(secret)
+	c, err := s.NewClient(srpUser, srpPass[:])
 	if err != nil {
 		return nil, err
 	}
@@ -58,19 +93,17 @@ func (qs *QSocket) InitClientSRP() ([]byte, error) {
 	creds := c.Credentials()
 
 	// Send the creds ro server
-	_, err = qs.Write([]byte(creds))
+	err = writeHandshakeFrame(rw, frameSrpCredentials, []byte(creds))
 	if err != nil {
 		return nil, err
 	}
 
 	// Receive the server credentials into 'server_creds'; this is the server
 	// public key and random salt generated when the verifier was created.
-	buf := make([]byte, 4096)
-	n, err := qs.Read(buf)
+	serverCreds, err := readHandshakeFrame(rw, frameSrpCredentials)
 	if err != nil {
 		return nil, err
 	}
-	serverCreds := buf[:n]
 
 	// Now, generate a mutual authenticator to be sent to the server
 	auth, err := c.Generate(string(serverCreds))
@@ -79,17 +112,16 @@ func (qs *QSocket) InitClientSRP() ([]byte, error) {
 	}
 
 	// Send the mutual authenticator to the server
-	_, err = qs.Write([]byte(auth))
+	err = writeHandshakeFrame(rw, frameSrpAuthenticator, []byte(auth))
 	if err != nil {
 		return nil, err
 	}
 
 	// 4. receive "proof" that the server too computed the same result.
-	n, err = qs.Read(buf)
+	proof, err := readHandshakeFrame(rw, frameSrpProof)
 	if err != nil {
 		return nil, err
 	}
-	proof := buf[:n]
 
 	// Verify that the server actually did what it claims
 	if !c.ServerOk(string(proof)) {
@@ -99,20 +131,15 @@ func (qs *QSocket) InitClientSRP() ([]byte, error) {
 	return c.RawKey(), nil
 }
 
-// InitServerSRP performs the server SRP sequence for establishing PAKE.
-func (qs *QSocket) InitServerSRP() ([]byte, error) {
-	if qs.IsClosed() {
-		return nil, ErrSocketNotConnected
-	}
-
-	srpUser := md5.Sum([]byte(qs.secret))
-	srpPass := sha256.Sum256([]byte(qs.secret))
+func srpServer(rw io.ReadWriter, secret []byte) ([]byte, error) {
+	srpUser := srpIdentity(secret)
+	srpPass := sha256.Sum256(secret)
 	s, err := srp.New(SRP_BITS)
 	if err != nil {
 		return nil, err
 	}
 
-	v, err := s.Verifier(srpUser[:], srpPass[:])
+	v, err := s.Verifier(srpUser, srpPass[:])
 	if err != nil {
 		return nil, err
 	}
@@ -121,12 +148,10 @@ func (qs *QSocket) InitServerSRP() ([]byte, error) {
 
 	// =====================================================================
 
-	buf := make([]byte, 4096)
-	n, err := qs.Read(buf)
+	clientCreds, err := readHandshakeFrame(rw, frameSrpCredentials)
 	if err != nil {
 		return nil, err
 	}
-	clientCreds := buf[:n]
 
 	// Parse the user info and authenticator from the 'creds' string
 	id, A, err := srp.ServerBegin(string(clientCreds))
@@ -155,17 +180,16 @@ func (qs *QSocket) InitServerSRP() ([]byte, error) {
 	s_creds := srv.Credentials()
 
 	// 1. send 's_creds' to the client
-	_, err = qs.Write([]byte(s_creds))
+	err = writeHandshakeFrame(rw, frameSrpCredentials, []byte(s_creds))
 	if err != nil {
 		return nil, err
 	}
 
 	// 2. receive 'm_auth' from the client
-	n, err = qs.Read(buf)
+	m_auth, err := readHandshakeFrame(rw, frameSrpAuthenticator)
 	if err != nil {
 		return nil, err
 	}
-	m_auth := buf[:n]
 
 	// Authenticate user and generate mutual proof of authentication
 	proof, ok := srv.ClientOk(string(m_auth))
@@ -174,7 +198,7 @@ func (qs *QSocket) InitServerSRP() ([]byte, error) {
 	}
 
 	// 3. Send proof to client
-	_, err = qs.Write([]byte(proof))
+	err = writeHandshakeFrame(rw, frameSrpProof, []byte(proof))
 	if err != nil {
 		return nil, err
 	}
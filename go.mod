@@ -3,11 +3,11 @@ module github.com/qsocket/qsocket-go
 go 1.19
 
 require (
+	github.com/gtank/ristretto255 v0.1.2
 	github.com/qsocket/encrypted-stream v0.0.0-20231023165659-580d263e71f4
 	github.com/qsocket/go-srp v0.0.0-20230315175014-fb16dd9247df
 	golang.org/x/crypto v0.14.0
 	golang.org/x/net v0.10.0
+	golang.org/x/sys v0.13.0
 	golang.org/x/text v0.14.0
 )
-
-require golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,207 @@
+package qsocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// E2E handshake frame layout:
+//
+//	| version (1) | type (1) | length (2) | payload (length) |
+const (
+	// HANDSHAKE_VERSION is the version of the E2E handshake frames.
+	HANDSHAKE_VERSION byte = 1
+	// handshakeHeaderSize is the size of a handshake frame header in bytes.
+	handshakeHeaderSize = 4
+	// maxHandshakePayload is the max payload size of a single handshake frame.
+	maxHandshakePayload = 8192
+	// maxHelloNames is the max number of names in a single hello frame list.
+	maxHelloNames = 16
+)
+
+// Handshake frame types.
+const (
+	// frameHello carries the offered (or chosen) key exchange names.
+	frameHello byte = iota + 1
+	// frameSrpCredentials carries the SRP credentials of a peer.
+	frameSrpCredentials
+	// frameSrpAuthenticator carries the SRP mutual authenticator of the client.
+	frameSrpAuthenticator
+	// frameSrpProof carries the SRP proof of the server.
+	frameSrpProof
+	// frameCPaceShare carries the CPace public share of a peer.
+	frameCPaceShare
+	// frameCPaceConfirm carries the CPace key confirmation of a peer.
+	frameCPaceConfirm
+)
+
+var (
+	ErrHandshakeVersion        = errors.New("Unsupported E2E handshake version.")
+	ErrHandshakeFrameTooLong   = errors.New("E2E handshake frame too long.")
+	ErrUnexpectedHandshakeType = errors.New("Unexpected E2E handshake frame type.")
+	ErrInvalidHelloFrame       = errors.New("Invalid E2E handshake hello frame.")
+)
+
+// hello is the payload of the hello frames used for the negotiation.
+// The client offers its key exchanges and cipher suites in preference
+// order, the server answers with the chosen ones.
+//
+//	| count (1) | [ length (1) | name ]... | count (1) | [ length (1) | name ]... |
+type hello struct {
+	keyExchanges []string
+	cipherSuites []string
+}
+
+// negotiate agrees on a key exchange and a cipher suite with the peer using hello frames.
+// The first offers of the client that the server also supports are used, except that
+// servers without AES hardware support choose the cipher suite in their own order.
+func negotiate(rw io.ReadWriter, sType SocketType, kxs []KeyExchange, suites []string) (KeyExchange, string, error) {
+	offer := hello{cipherSuites: suites}
+	for _, kx := range kxs {
+		offer.keyExchanges = append(offer.keyExchanges, kx.Name())
+	}
+
+	var chosen hello
+	if sType == Client {
+		err := writeHelloFrame(rw, offer)
+		if err != nil {
+			return nil, "", err
+		}
+		chosen, err = readHelloFrame(rw)
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		peerOffer, err := readHelloFrame(rw)
+		if err != nil {
+			return nil, "", err
+		}
+		chosen.keyExchanges = firstCommon(peerOffer.keyExchanges, offer.keyExchanges)
+		chosen.cipherSuites = firstCommon(peerOffer.cipherSuites, offer.cipherSuites)
+		if !hasAESGCMHardwareSupport() {
+			// Avoid the slow software AES-GCM, the default order prefers ChaCha20-Poly1305.
+			chosen.cipherSuites = firstCommon(offer.cipherSuites, peerOffer.cipherSuites)
+		}
+		// Answer even without a match for letting the client know.
+		err = writeHelloFrame(rw, chosen)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if len(chosen.keyExchanges) != 1 {
+		return nil, "", ErrNoCommonKeyExchange
+	}
+	if len(chosen.cipherSuites) != 1 || len(firstCommon(chosen.cipherSuites, suites)) == 0 {
+		return nil, "", ErrNoCommonCipherSuite
+	}
+	for _, kx := range kxs {
+		if kx.Name() == chosen.keyExchanges[0] {
+			return kx, chosen.cipherSuites[0], nil
+		}
+	}
+	return nil, "", ErrNoCommonKeyExchange
+}
+
+// firstCommon returns the first name of the offer that is also supported, or none.
+func firstCommon(offer, supported []string) []string {
+	for _, name := range offer {
+		for _, s := range supported {
+			if name == s {
+				return []string{name}
+			}
+		}
+	}
+	return nil
+}
+
+// writeHelloFrame writes a hello frame with the given name lists.
+func writeHelloFrame(w io.Writer, h hello) error {
+	payload := []byte{}
+	for _, names := range [][]string{h.keyExchanges, h.cipherSuites} {
+		if len(names) > maxHelloNames {
+			return ErrInvalidHelloFrame
+		}
+		payload = append(payload, byte(len(names)))
+		for _, name := range names {
+			if len(name) == 0 || len(name) > 255 {
+				return ErrInvalidHelloFrame
+			}
+			payload = append(payload, byte(len(name)))
+			payload = append(payload, name...)
+		}
+	}
+	return writeHandshakeFrame(w, frameHello, payload)
+}
+
+// readHelloFrame reads a hello frame and returns the name lists in it.
+func readHelloFrame(r io.Reader) (hello, error) {
+	payload, err := readHandshakeFrame(r, frameHello)
+	if err != nil {
+		return hello{}, err
+	}
+	lists := make([][]string, 2)
+	for i := range lists {
+		if len(payload) == 0 || payload[0] > maxHelloNames {
+			return hello{}, ErrInvalidHelloFrame
+		}
+		count := int(payload[0])
+		payload = payload[1:]
+		for j := 0; j < count; j++ {
+			if len(payload) == 0 {
+				return hello{}, ErrInvalidHelloFrame
+			}
+			n := int(payload[0])
+			if n == 0 || n >= len(payload) {
+				return hello{}, ErrInvalidHelloFrame
+			}
+			lists[i] = append(lists[i], string(payload[1:n+1]))
+			payload = payload[n+1:]
+		}
+	}
+	if len(payload) != 0 {
+		return hello{}, ErrInvalidHelloFrame
+	}
+	return hello{keyExchanges: lists[0], cipherSuites: lists[1]}, nil
+}
+
+// writeHandshakeFrame writes a single handshake frame with the given type and payload.
+func writeHandshakeFrame(w io.Writer, frameType byte, payload []byte) error {
+	if len(payload) > maxHandshakePayload {
+		return ErrHandshakeFrameTooLong
+	}
+	frame := make([]byte, handshakeHeaderSize, handshakeHeaderSize+len(payload))
+	frame[0] = HANDSHAKE_VERSION
+	frame[1] = frameType
+	binary.BigEndian.PutUint16(frame[2:4], uint16(len(payload)))
+	frame = append(frame, payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readHandshakeFrame reads a single handshake frame and returns its payload.
+// The frame must be of the expected type.
+func readHandshakeFrame(r io.Reader, frameType byte) ([]byte, error) {
+	var hdr [handshakeHeaderSize]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	if hdr[0] != HANDSHAKE_VERSION {
+		return nil, ErrHandshakeVersion
+	}
+	if hdr[1] != frameType {
+		return nil, ErrUnexpectedHandshakeType
+	}
+	length := binary.BigEndian.Uint16(hdr[2:4])
+	if length > maxHandshakePayload {
+		return nil, ErrHandshakeFrameTooLong
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
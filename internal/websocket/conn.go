@@ -0,0 +1,258 @@
+// Package websocket implements the RFC 6455 data framing used by the
+// QSocket websocket transport mode, on top of an already switched connection.
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Frame opcodes.
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+const (
+	finBit  = 0x80
+	maskBit = 0x80
+	// maxControlPayload is the max payload size of control frames.
+	maxControlPayload = 125
+	// closeTimeout bounds sending the close frame.
+	closeTimeout = time.Second
+)
+
+var (
+	ErrProtocol     = errors.New("Websocket protocol error.")
+	ErrFrameTooLong = errors.New("Websocket frame too long.")
+)
+
+// Conn is a websocket framed connection, every Write is sent as a single
+// binary frame and Read returns the payloads of the received data frames.
+// Ping frames are answered automatically and a close frame ends the stream.
+type Conn struct {
+	net.Conn
+	client bool
+
+	readMu    sync.Mutex
+	remaining uint64
+	masked    bool
+	maskKey   [4]byte
+	maskPos   int
+	eof       bool
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewConn creates a websocket framed connection on top of the given connection.
+// Client side connections mask the written frames as required by the RFC.
+// A positive ping interval enables periodic keepalive pings.
+func NewConn(conn net.Conn, client bool, pingInterval time.Duration) *Conn {
+	c := &Conn{
+		Conn:   conn,
+		client: client,
+		done:   make(chan struct{}),
+	}
+	if pingInterval > 0 {
+		go c.keepalive(pingInterval)
+	}
+	return c
+}
+
+// Read reads the payload of the received data frames.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for c.remaining == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		err := c.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.Conn.Read(b)
+	if c.masked {
+		c.unmask(b[:n])
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads the next frame header, control frames are handled in place.
+func (c *Conn) nextFrame() error {
+	var hdr [2]byte
+	_, err := io.ReadFull(c.Conn, hdr[:])
+	if err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0x0F
+	c.masked = hdr[1]&maskBit != 0
+	length := uint64(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.Conn, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.Conn, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return ErrFrameTooLong
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if c.masked {
+		_, err = io.ReadFull(c.Conn, c.maskKey[:])
+		if err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		return nil
+	case opClose, opPing, opPong:
+		if length > maxControlPayload || hdr[0]&finBit == 0 {
+			return ErrProtocol
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(c.Conn, payload)
+		if err != nil {
+			return err
+		}
+		if c.masked {
+			c.unmask(payload)
+		}
+		switch opcode {
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		case opClose:
+			// Echo the close frame and end the stream.
+			c.writeClose(payload)
+			c.eof = true
+		}
+		return nil
+	default:
+		return ErrProtocol
+	}
+}
+
+func (c *Conn) unmask(b []byte) {
+	for i := range b {
+		b[i] ^= c.maskKey[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// Write writes the given data as a single binary frame.
+func (c *Conn) Write(b []byte) (int, error) {
+	err := c.writeFrame(opBinary, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Ping sends a ping frame with the given payload.
+func (c *Conn) Ping(payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return ErrFrameTooLong
+	}
+	return c.writeFrame(opPing, payload)
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, finBit|opcode)
+
+	var maskFlag byte
+	if c.client {
+		maskFlag = maskBit
+	}
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, maskFlag|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskFlag|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskFlag|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if c.client {
+		var key [4]byte
+		_, err := rand.Read(key[:])
+		if err != nil {
+			return err
+		}
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= key[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *Conn) writeClose(payload []byte) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.writeFrame(opClose, payload)
+		c.Conn.SetWriteDeadline(time.Time{})
+	})
+}
+
+// Close sends a normal closure frame and closes the underlying connection.
+func (c *Conn) Close() error {
+	// 1000 = normal closure
+	c.writeClose([]byte{0x03, 0xE8})
+	return c.Conn.Close()
+}
+
+func (c *Conn) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.Ping(nil) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package qsocket
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// HKDF labels of the E2E key schedule.
+const (
+	labelClientToServer = "qsocket e2e v1 c2s"
+	labelServerToClient = "qsocket e2e v1 s2c"
+	labelTrafficKey     = "qsocket e2e v1 key"
+	labelTrafficNonce   = "qsocket e2e v1 nonce"
+	labelTrafficUpdate  = "qsocket e2e v1 update"
+)
+
+// trafficSecretSize is the size of the directional traffic secrets.
+const trafficSecretSize = 32
+
+var (
+	ErrInvalidNonceSize = errors.New("Invalid E2E nonce size.")
+	ErrInvalidEpoch     = errors.New("Invalid E2E key epoch.")
+)
+
+// transcript records the handshake bytes sent in each direction.
+type transcript struct {
+	rw    io.ReadWriter
+	sType SocketType
+	sent  hash.Hash
+	recvd hash.Hash
+}
+
+func newTranscript(rw io.ReadWriter, sType SocketType) *transcript {
+	return &transcript{
+		rw:    rw,
+		sType: sType,
+		sent:  sha256.New(),
+		recvd: sha256.New(),
+	}
+}
+
+func (t *transcript) Read(b []byte) (int, error) {
+	n, err := t.rw.Read(b)
+	t.recvd.Write(b[:n])
+	return n, err
+}
+
+func (t *transcript) Write(b []byte) (int, error) {
+	n, err := t.rw.Write(b)
+	t.sent.Write(b[:n])
+	return n, err
+}
+
+// Sum returns the transcript hash, it is the same for both peers.
+func (t *transcript) Sum() []byte {
+	c2s, s2c := t.sent, t.recvd
+	if t.sType != Client {
+		c2s, s2c = s2c, c2s
+	}
+	h := sha256.New()
+	h.Write(c2s.Sum(nil))
+	h.Write(s2c.Sum(nil))
+	return h.Sum(nil)
+}
+
+// deriveTrafficSecrets derives the client to server and server to client
+// traffic secrets from the session key and the handshake transcript hash.
+func deriveTrafficSecrets(sessionKey, transcriptHash []byte) (c2s, s2c []byte, err error) {
+	prk := hkdf.Extract(sha256.New, sessionKey, transcriptHash)
+	c2s, err = expandLabel(prk, labelClientToServer, trafficSecretSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	s2c, err = expandLabel(prk, labelServerToClient, trafficSecretSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c2s, s2c, nil
+}
+
+func expandLabel(secret []byte, label string, size int) ([]byte, error) {
+	out := make([]byte, size)
+	_, err := io.ReadFull(hkdf.Expand(sha256.New, secret, []byte(label)), out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// trafficCipher is an AEAD keyed with a traffic secret, the
+// nonces of the stream are XOR'ed with a secret nonce base.
+// The traffic secret is ratcheted forward for every new key epoch.
+type trafficCipher struct {
+	suite     string
+	secret    []byte
+	epoch     uint64
+	aead      cipher.AEAD
+	nonceBase []byte
+	nonce     []byte
+	// Usage of the current key.
+	bytes   int64
+	started time.Time
+}
+
+func newTrafficCipher(suite string, secret []byte, epoch uint64) (*trafficCipher, error) {
+	key, err := expandLabel(secret, labelTrafficKey, 32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(suite, key)
+	zero(key)
+	if err != nil {
+		return nil, err
+	}
+	nonceBase, err := expandLabel(secret, labelTrafficNonce, aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return &trafficCipher{
+		suite:     suite,
+		secret:    secret,
+		epoch:     epoch,
+		aead:      aead,
+		nonceBase: nonceBase,
+		nonce:     make([]byte, aead.NonceSize()),
+		started:   time.Now(),
+	}, nil
+}
+
+// next returns the traffic cipher of the next key epoch.
+func (c *trafficCipher) next() (*trafficCipher, error) {
+	secret, err := expandLabel(c.secret, labelTrafficUpdate, trafficSecretSize)
+	if err != nil {
+		return nil, err
+	}
+	return newTrafficCipher(c.suite, secret, c.epoch+1)
+}
+
+// destroy erases the key material of the previous epochs for forward secrecy.
+func (c *trafficCipher) destroy() {
+	zero(c.secret)
+	zero(c.nonceBase)
+}
+
+func (c *trafficCipher) xorNonce(nonce []byte) ([]byte, error) {
+	if len(nonce) != len(c.nonceBase) {
+		return nil, ErrInvalidNonceSize
+	}
+	for i := range c.nonce {
+		c.nonce[i] = c.nonceBase[i] ^ nonce[i]
+	}
+	return c.nonce, nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// e2eCipher implements the encrypted stream cipher with separate keys for each direction.
+// Encrypt and Decrypt are serialized by the encrypted stream for each direction.
+//
+// Every chunk starts with the key epoch of the sender, authenticated as additional data:
+//
+//	| epoch (1) | sealed chunk |
+//
+// The sender moves to the next epoch after the rekey limits are reached and
+// the receiver follows when it sees the next epoch, so no extra messages are needed.
+type e2eCipher struct {
+	send *trafficCipher
+	recv *trafficCipher
+
+	// The overhead and nonce size are fixed by the suite, they are kept
+	// apart since the stream reads them concurrently with key rotations.
+	overhead  int
+	nonceSize int
+
+	rekeyBytes    int64
+	rekeyInterval time.Duration
+	logf          func(format string, v ...any)
+}
+
+func newE2ECipher(qs *QSocket, suite string, sessionKey, transcriptHash []byte) (*e2eCipher, error) {
+	c2s, s2c, err := deriveTrafficSecrets(sessionKey, transcriptHash)
+	if err != nil {
+		return nil, err
+	}
+	if !qs.IsClient() {
+		c2s, s2c = s2c, c2s
+	}
+	send, err := newTrafficCipher(suite, c2s, 0)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newTrafficCipher(suite, s2c, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eCipher{
+		send:          send,
+		recv:          recv,
+		overhead:      1 + send.aead.Overhead(),
+		nonceSize:     send.aead.NonceSize(),
+		rekeyBytes:    qs.config.rekeyBytes(),
+		rekeyInterval: qs.config.rekeyInterval(),
+		logf:          qs.logf,
+	}, nil
+}
+
+func (c *e2eCipher) Encrypt(ciphertext, plaintext, nonce []byte) ([]byte, error) {
+	if c.send.bytes >= c.rekeyBytes || time.Since(c.send.started) >= c.rekeyInterval {
+		next, err := c.send.next()
+		if err != nil {
+			return nil, err
+		}
+		c.send.destroy()
+		c.send = next
+		c.logf("E2E send key rotated (epoch %d)", c.send.epoch)
+	}
+
+	n, err := c.send.xorNonce(nonce)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext[0] = byte(c.send.epoch)
+	sealed := c.send.aead.Seal(ciphertext[1:1], n, plaintext, ciphertext[:1])
+	c.send.bytes += int64(len(plaintext))
+	return ciphertext[:1+len(sealed)], nil
+}
+
+func (c *e2eCipher) Decrypt(plaintext, ciphertext, nonce []byte) ([]byte, error) {
+	if len(ciphertext) < 1 {
+		return nil, ErrInvalidEpoch
+	}
+	recv := c.recv
+	switch ciphertext[0] {
+	case byte(c.recv.epoch):
+	case byte(c.recv.epoch + 1):
+		// The peer moved to the next epoch, the new key is only kept if the chunk is authentic.
+		next, err := c.recv.next()
+		if err != nil {
+			return nil, err
+		}
+		recv = next
+	default:
+		return nil, ErrInvalidEpoch
+	}
+
+	n, err := recv.xorNonce(nonce)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err = recv.aead.Open(plaintext[:0], n, ciphertext[1:], ciphertext[:1])
+	if err != nil {
+		return nil, err
+	}
+	if recv != c.recv {
+		c.recv.destroy()
+		c.recv = recv
+		c.logf("E2E receive key rotated (epoch %d)", c.recv.epoch)
+	}
+	return plaintext, nil
+}
+
+func (c *e2eCipher) MaxOverhead() int {
+	return c.overhead
+}
+
+func (c *e2eCipher) NonceSize() int {
+	return c.nonceSize
+}
@@ -1,12 +1,21 @@
 package qsocket
 
 import (
-	"crypto/md5"
+	"bufio"
+	"context"
+	"crypto/sha1"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
+	"time"
+
+	"github.com/qsocket/qsocket-go/internal/websocket"
 )
 
 // Some global constants for
@@ -24,6 +33,12 @@ const (
 	CHECKSUM_BASE = 0xEE
 	URI_CHARSET   = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-"
 	CRLF          = "\r\n"
+	// WEBSOCKET_GUID is the magic value used for calculating `Sec-WebSocket-Accept` values. (RFC 6455)
+	WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// WEBSOCKET_PROTOCOL is the `Sec-WebSocket-Protocol` value for requesting websocket framing from the relay.
+	WEBSOCKET_PROTOCOL = "qsocket"
+	// maxRelayMessageSize is the max size of the relay response body.
+	maxRelayMessageSize = 4096
 )
 
 var (
@@ -33,6 +48,8 @@ var (
 	ErrServerCollision                     = errors.New("Address already in use. (server secret collision)")
 	ErrPeerNotFound                        = errors.New("Connection refused. (no server listening with given secret)")
 	ErrUpgradeRequired                     = errors.New("Protocol upgrade required!")
+	ErrInvalidWebsocketAccept              = errors.New("Invalid Sec-WebSocket-Accept value.")
+	ErrWebsocketUnsupported                = errors.New("Relay does not support websocket framing.")
 
 	HttpResponseRgx    = regexp.MustCompile(`^HTTP/([0-9]|[0-9]\.[0-9]) ([0-9]{1,3}) [a-z A-Z]+`)
 	WebsocketAcceptRgx = regexp.MustCompile(`Sec-WebSocket-Accept: ([A-Za-z0-9+/]+={0,2})`)
@@ -49,65 +66,122 @@ var (
 // SendKnockSequence sends a knock sequence to the QSRN gate
 // with the socket properties.
 func (qs *QSocket) DoWsProtocolSwitch() error {
-	if qs.IsClosed() {
+	transport := qs.transportConn()
+	if transport == nil {
 		return ErrSocketNotConnected
 	}
 
-	uid := md5.Sum([]byte(qs.secret))
-	req := fmt.Sprintf("GET /%s HTTP/1.1\n", NewChecksumUri(qs.socketType))
-	req += fmt.Sprintf("Host: %s\n", QSRN_GATE)
-	req += fmt.Sprintf("User-Agent: %s\n", GetDeviceUserAgent())
-	req += "Sec-WebSocket-Version: 13\n"
-	req += fmt.Sprintf(
-		"Sec-WebSocket-Key: %s\n",
-		base64.StdEncoding.EncodeToString(uid[:]),
-	)
-	req += "Connection: Upgrade\n"
-	req += "Upgrade: websocket"
-	req += (CRLF + CRLF)
-
-	n, err := qs.Write([]byte(req))
+	uid := qs.secretKeys().uid
+	key := base64.StdEncoding.EncodeToString(uid[:])
+	req := qs.newKnockRequest(key)
+	bw := bufio.NewWriter(transport)
+	err := req.Write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
 	if err != nil {
 		return err
 	}
-	if n != len(req) {
-		return ErrProtocolSwitchFailed
-	}
 
-	buf := make([]byte, 4096)
-	n, err = qs.Read(buf)
+	br := bufio.NewReader(transport)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return ErrFailedReadingProtocolSwitchResponse
+		}
+		var ne net.Error
+		if errors.As(err, &ne) {
+			return err
+		}
+		return ErrInvalidProtocolSwitchResponse
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRelayMessageSize))
+	resp.Body.Close()
 	if err != nil {
 		return err
 	}
+	qs.mu.Lock()
+	qs.relayResp = resp
+	qs.mu.Unlock()
 
-	if !HttpResponseRgx.Match(buf[:n]) {
-		return ErrInvalidProtocolSwitchResponse
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return newRelayError(resp, body)
 	}
 
-	resp := HttpResponseRgx.FindStringSubmatch(string(buf[:n]))
-	if len(resp) != 3 {
-		return ErrInvalidProtocolSwitchResponse
+	// Relays that send an accept key must send the correct one.
+	accept := resp.Header.Get("Sec-WebSocket-Accept")
+	if accept != "" && accept != WebsocketAcceptKey(key) {
+		return ErrInvalidWebsocketAccept
 	}
-
-	switch resp[2] { // Status code
-	case "101":
-		return nil
-	case "404":
-		return ErrPeerNotFound
-	case "409":
-		return ErrServerCollision
-	case "426":
-		relayMessage := strings.Split(string(buf[:n]), "\n\n")
-		if len(relayMessage) > 1 {
-			return fmt.Errorf("%s", relayMessage[1])
+	// Keep the bytes of the peer stream that are already buffered.
+	if br.Buffered() > 0 {
+		err = qs.updateStack(func() {
+			qs.transport = &bufferedConn{Conn: transport, br: br}
+		})
+		if err != nil {
+			return err
 		}
-		return ErrUpgradeRequired
-	default:
-		return ErrInvalidProtocolSwitchResponse
 	}
+	if qs.config.WebSocket {
+		return qs.initWebsocket(resp)
+	}
+	return nil
+}
+
+// newKnockRequest creates the knock request with the given websocket key.
+func (qs *QSocket) newKnockRequest(key string) *http.Request {
+	// Header names are set directly for keeping the RFC 6455 casing.
+	header := http.Header{
+		"User-Agent":            {qs.userAgent()},
+		"Sec-WebSocket-Version": {"13"},
+		"Sec-WebSocket-Key":     {key},
+		"Connection":            {"Upgrade"},
+		"Upgrade":               {"websocket"},
+	}
+	if qs.config.WebSocket {
+		header["Sec-WebSocket-Protocol"] = []string{WEBSOCKET_PROTOCOL}
+	}
+	return &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: "/" + NewChecksumUri(qs.socketType)},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Host:       qs.config.hostHeader(),
+	}
+}
+
+// RelayResponse returns the parsed protocol switch response of the relay,
+// or nil if the socket is not dialed yet. The response body is already consumed.
+func (qs *QSocket) RelayResponse() *http.Response {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+	return qs.relayResp
+}
+
+// initWebsocket validates the websocket handshake response
+// and switches the transport to websocket framing.
+func (qs *QSocket) initWebsocket(resp *http.Response) error {
+	if resp.Header.Get("Sec-WebSocket-Accept") == "" {
+		return ErrInvalidWebsocketAccept
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != WEBSOCKET_PROTOCOL {
+		return ErrWebsocketUnsupported
+	}
+
+	return qs.updateStack(func() {
+		qs.transport = websocket.NewConn(qs.transport, true, qs.config.WebSocketPingInterval)
+	})
 }
 
 func (qs *QSocket) InitiateKnockSequence() error {
+	return qs.initiateKnockSequence(context.Background())
+}
+
+// initiateKnockSequence performs the knock sequence within the dial context,
+// the connection deadline set by the context watcher is never overwritten.
+func (qs *QSocket) initiateKnockSequence(ctx context.Context) error {
 	if qs.IsClosed() {
 		return ErrSocketNotConnected
 	}
@@ -116,22 +190,120 @@ func (qs *QSocket) InitiateKnockSequence() error {
 	if err != nil {
 		return err
 	}
+	qs.logf("Protocol switch completed")
 
-	if qs.e2e {
-		sessionKey := []byte{}
-		if qs.IsClient() {
-			sessionKey, err = qs.InitClientSRP()
-		} else {
-			sessionKey, err = qs.InitServerSRP()
+	if qs.config.E2E {
+		// Bound the key exchange, the peer may never answer. The context is checked
+		// after setting the deadline, in case the watcher fired just before it.
+		deadline := time.Now().Add(qs.config.keyExchangeTimeout())
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
 		}
-		if err != nil {
+		qs.SetDeadline(deadline)
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 
-		err = qs.InitE2ECipher(sessionKey)
+		sessionKey, err := qs.InitKeyExchange()
+		if err == nil {
+			err = qs.InitE2ECipher(sessionKey)
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		qs.SetDeadline(time.Time{})
 		if err != nil {
 			return err
 		}
+		qs.logf("E2E encryption initiated")
 	}
 	return nil
 }
+
+func (qs *QSocket) userAgent() string {
+	if qs.config.UserAgent != "" {
+		return qs.config.UserAgent
+	}
+	return GetDeviceUserAgent()
+}
+
+// RelayError is a non protocol switch response of the relay to the knock request.
+// It matches the corresponding sentinel error (e.g. ErrPeerNotFound) with errors.Is.
+type RelayError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Status is the HTTP status line of the response, e.g. "404 Not Found".
+	Status string
+	// Header contains the response headers.
+	Header http.Header
+	// Message is the response body sent by the relay, if any.
+	Message string
+	// Retryable reports whether dialing again later may succeed.
+	Retryable bool
+}
+
+func newRelayError(resp *http.Response, body []byte) *RelayError {
+	e := &RelayError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     resp.Header,
+		Message:    strings.TrimSpace(string(body)),
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound,
+		http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		e.Retryable = true
+	}
+	return e
+}
+
+// Error returns the relay message if there is one, otherwise the matching sentinel error text.
+func (e *RelayError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	if err := e.Unwrap(); err != ErrInvalidProtocolSwitchResponse {
+		return err.Error()
+	}
+	return fmt.Sprintf("%s (%s)", ErrInvalidProtocolSwitchResponse, e.Status)
+}
+
+// Unwrap returns the sentinel error matching the status code.
+func (e *RelayError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return ErrPeerNotFound
+	case http.StatusConflict:
+		return ErrServerCollision
+	case http.StatusUpgradeRequired:
+		return ErrUpgradeRequired
+	default:
+		return ErrInvalidProtocolSwitchResponse
+	}
+}
+
+// bufferedConn is a connection with buffered bytes that
+// were read past the protocol switch response.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+// Read reads the buffered bytes first, then reads from the connection directly.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if c.br.Buffered() > 0 {
+		return c.br.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// WebsocketAcceptKey calculates the expected `Sec-WebSocket-Accept`
+// header value for the given `Sec-WebSocket-Key`.
+func WebsocketAcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
@@ -0,0 +1,190 @@
+package qsocket
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxConns is the default number of concurrently accepted connections of a Listener.
+	DefaultMaxConns = 16
+	// Backoff limits for re-registering with the relay after failures.
+	listenMinBackoff = 100 * time.Millisecond
+	listenMaxBackoff = 10 * time.Second
+)
+
+// A Listener accepts QSocket peers connecting with the same secret.
+// After each pairing, a new server socket is registered with the relay,
+// so the listener can serve many clients one after another.
+//
+// The number of concurrently accepted connections is bounded by `Config.MaxConns`,
+// no new registration is made until one of the accepted connections is closed.
+type Listener struct {
+	secret string
+	keys   *secretKeys
+	config *Config
+
+	accepts chan acceptResult
+	slots   chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Listener implements the net.Listener interface.
+var _ net.Listener = (*Listener)(nil)
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// acceptError wraps a failed relay registration, it is reported as temporary
+// so that servers (e.g. `http.Server`) keep accepting.
+type acceptError struct {
+	err error
+}
+
+func (e *acceptError) Error() string   { return e.err.Error() }
+func (e *acceptError) Unwrap() error   { return e.err }
+func (e *acceptError) Timeout() bool   { return false }
+func (e *acceptError) Temporary() bool { return true }
+
+// listenerConn releases its listener slot when closed.
+type listenerConn struct {
+	*QSocket
+	once    sync.Once
+	release func()
+}
+
+func (c *listenerConn) Close() error {
+	err := c.QSocket.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// Listen announces a server with the given secret on the QSRN and returns
+// a net.Listener that accepts the connecting clients.
+func Listen(secret string, cfg *Config) (net.Listener, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	maxConns := cfg.MaxConns
+	if maxConns == 0 {
+		maxConns = DefaultMaxConns
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Listener{
+		secret:  secret,
+		keys:    deriveSecretKeys(secret, cfg.uidVersion()),
+		config:  cfg.Clone(),
+		accepts: make(chan acceptResult),
+		slots:   make(chan struct{}, maxConns),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+// serve keeps a server socket registered with the relay while there are free slots.
+func (l *Listener) serve() {
+	defer close(l.done)
+
+	backoff := listenMinBackoff
+	for {
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.ctx.Done():
+			return
+		}
+
+		conn, err := l.register()
+		if err != nil {
+			<-l.slots
+			if l.ctx.Err() != nil {
+				return
+			}
+			if !l.deliver(acceptResult{err: &acceptError{err}}) || !l.sleep(backoff) {
+				return
+			}
+			backoff *= 2
+			if backoff > listenMaxBackoff {
+				backoff = listenMaxBackoff
+			}
+			continue
+		}
+
+		backoff = listenMinBackoff
+		if !l.deliver(acceptResult{conn: conn}) {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// register dials a new server socket and waits for a client to pair.
+func (l *Listener) register() (net.Conn, error) {
+	qs, err := NewSocketWithConfig(Server, l.secret, l.config)
+	if err != nil {
+		return nil, err
+	}
+	qs.keys = l.keys
+	err = qs.DialContext(l.ctx, l.config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return &listenerConn{
+		QSocket: qs,
+		release: func() { <-l.slots },
+	}, nil
+}
+
+func (l *Listener) deliver(res acceptResult) bool {
+	select {
+	case l.accepts <- res:
+		return true
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+func (l *Listener) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+// Accept waits for and returns the next paired client connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case res := <-l.accepts:
+		return res.conn, res.err
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops registering with the relay and unblocks pending Accept calls.
+// Already accepted connections are not closed.
+func (l *Listener) Close() error {
+	l.cancel()
+	<-l.done
+	return nil
+}
+
+// Addr returns the QSocket address of the listener.
+func (l *Listener) Addr() net.Addr {
+	return newAddr(Server, l.keys)
+}
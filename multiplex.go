@@ -0,0 +1,21 @@
+package qsocket
+
+import (
+	"github.com/qsocket/qsocket-go/mux"
+)
+
+// Multiplex starts a stream multiplexing session over the QSocket connection,
+// both peers must call Multiplex for opening/accepting streams.
+// A nil config means `mux.DefaultConfig()`.
+//
+// After calling Multiplex, the socket must not be read or written directly;
+// closing the session also closes the socket.
+func (qs *QSocket) Multiplex(cfg *mux.Config) (*mux.Session, error) {
+	if qs.IsClosed() {
+		return nil, ErrSocketNotConnected
+	}
+	if qs.IsClient() {
+		return mux.Client(qs, cfg)
+	}
+	return mux.Server(qs, cfg)
+}
@@ -0,0 +1,63 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// protoVersion is the multiplexing protocol version.
+	protoVersion byte = 0
+	// headerSize is the size of a frame header in bytes.
+	headerSize = 12
+	// maxFrameSize is the max payload size of a single data frame.
+	maxFrameSize = 32 * 1024
+)
+
+// Frame types.
+const (
+	// typeData carries stream data in the payload.
+	typeData byte = iota
+	// typeWindowUpdate grants the peer additional send window, the delta is in the length field.
+	typeWindowUpdate
+	// typePing is used for keepalives, the ping ID is in the length field.
+	typePing
+	// typeGoAway announces the session termination.
+	typeGoAway
+)
+
+// Frame flags.
+const (
+	// flagSYN opens a new stream, or marks a ping request.
+	flagSYN uint16 = 1 << iota
+	// flagACK marks a ping response.
+	flagACK
+	// flagFIN half-closes the stream, no more data will be sent.
+	flagFIN
+	// flagRST resets the stream immediately.
+	flagRST
+)
+
+// header is a frame header:
+//
+//	| version (1) | type (1) | flags (2) | stream ID (4) | length (4) |
+type header [headerSize]byte
+
+func (h header) version() byte    { return h[0] }
+func (h header) msgType() byte    { return h[1] }
+func (h header) flags() uint16    { return binary.BigEndian.Uint16(h[2:4]) }
+func (h header) streamID() uint32 { return binary.BigEndian.Uint32(h[4:8]) }
+func (h header) length() uint32   { return binary.BigEndian.Uint32(h[8:12]) }
+
+func (h *header) encode(msgType byte, flags uint16, streamID, length uint32) {
+	h[0] = protoVersion
+	h[1] = msgType
+	binary.BigEndian.PutUint16(h[2:4], flags)
+	binary.BigEndian.PutUint32(h[4:8], streamID)
+	binary.BigEndian.PutUint32(h[8:12], length)
+}
+
+func readHeader(r io.Reader, h *header) error {
+	_, err := io.ReadFull(r, h[:])
+	return err
+}
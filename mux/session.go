@@ -0,0 +1,360 @@
+// Package mux implements stream multiplexing over a single QSocket session.
+//
+// Many logical streams (shell, file transfer, port forwards...) can be run
+// over one relay pairing. Each stream is a net.Conn with its own flow control
+// window and can be half-closed or reset independently of the others.
+//
+// Both peers can open and accept streams, the peer roles only determine the
+// stream ID space (clients use odd, servers use even IDs).
+package mux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrSessionClosed    = errors.New("Mux session closed.")
+	ErrStreamClosed     = errors.New("Mux stream closed.")
+	ErrStreamReset      = errors.New("Mux stream reset by peer.")
+	ErrStreamsExhausted = errors.New("Mux stream IDs exhausted.")
+	ErrProtocol         = errors.New("Mux protocol error.")
+	ErrKeepAliveTimeout = errors.New("Mux keepalive timeout.")
+
+	ErrInvalidAcceptBacklog     = errors.New("Mux accept backlog must be greater than 0.")
+	ErrInvalidStreamWindow      = errors.New("Mux stream window is smaller than the max frame size.")
+	ErrInvalidKeepAliveInterval = errors.New("Mux keepalive interval must not be negative.")
+)
+
+// Config is used to tune the multiplexing session.
+type Config struct {
+	// AcceptBacklog is the max number of opened streams waiting to be accepted.
+	AcceptBacklog int
+	// MaxStreamWindow is the receive window size of each stream in bytes.
+	MaxStreamWindow uint32
+	// KeepAliveInterval is the interval of keepalive pings, zero disables keepalives.
+	// The session is closed if the peer does not respond in three intervals.
+	KeepAliveInterval time.Duration
+}
+
+// DefaultConfig returns the default multiplexing configuration.
+func DefaultConfig() *Config {
+	return &Config{
+		AcceptBacklog:     256,
+		MaxStreamWindow:   256 * 1024,
+		KeepAliveInterval: 30 * time.Second,
+	}
+}
+
+// Validate checks whether the config values are valid.
+func (c *Config) Validate() error {
+	if c.AcceptBacklog <= 0 {
+		return ErrInvalidAcceptBacklog
+	}
+	if c.MaxStreamWindow < maxFrameSize {
+		return ErrInvalidStreamWindow
+	}
+	if c.KeepAliveInterval < 0 {
+		return ErrInvalidKeepAliveInterval
+	}
+	return nil
+}
+
+// Session multiplexes streams over a single connection.
+type Session struct {
+	conn   io.ReadWriteCloser
+	config *Config
+
+	nextID   uint32
+	streams  map[uint32]*Stream
+	mu       sync.Mutex
+	accepts  chan *Stream
+	writeMu  sync.Mutex
+	lastRecv atomic.Int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	closeErr  error
+}
+
+// Client creates a client side multiplexing session over the given connection.
+func Client(conn io.ReadWriteCloser, config *Config) (*Session, error) {
+	return newSession(conn, config, 1)
+}
+
+// Server creates a server side multiplexing session over the given connection.
+func Server(conn io.ReadWriteCloser, config *Config) (*Session, error) {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn io.ReadWriteCloser, config *Config, firstID uint32) (*Session, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		conn:    conn,
+		config:  config,
+		nextID:  firstID,
+		streams: make(map[uint32]*Stream),
+		accepts: make(chan *Stream, config.AcceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	s.lastRecv.Store(time.Now().UnixNano())
+	go s.recvLoop()
+	if config.KeepAliveInterval > 0 {
+		go s.keepalive()
+	}
+	return s, nil
+}
+
+// OpenStream opens a new stream to the peer.
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextID
+	if id >= 1<<31 {
+		s.mu.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	// Announce the stream with a zero window update.
+	err := s.writeFrame(typeWindowUpdate, flagSYN, id, 0, nil)
+	if err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for and returns the next stream opened by the peer.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.closed:
+		return nil, s.err()
+	}
+}
+
+// Accept implements net.Listener, it is an alias of AcceptStream.
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+// Open is an alias of OpenStream returning a net.Conn.
+func (s *Session) Open() (net.Conn, error) {
+	return s.OpenStream()
+}
+
+// Addr implements net.Listener.
+func (s *Session) Addr() net.Addr {
+	if c, ok := s.conn.(net.Conn); ok {
+		return c.LocalAddr()
+	}
+	return nil
+}
+
+// NumStreams returns the number of active streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed checks if the session is closed.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan returns a channel that is closed when the session ends.
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.closed
+}
+
+// Close announces the session termination to the peer and closes the
+// underlying connection. All streams are closed.
+func (s *Session) Close() error {
+	s.writeFrame(typeGoAway, 0, 0, 0, nil)
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closeErr = err
+		close(s.closed)
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+		s.conn.Close()
+	})
+}
+
+func (s *Session) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeErr
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// writeFrame writes a single frame to the underlying connection.
+func (s *Session) writeFrame(msgType byte, flags uint16, id, length uint32, payload []byte) error {
+	if s.IsClosed() {
+		return s.err()
+	}
+
+	buf := make([]byte, headerSize+len(payload))
+	var h header
+	h.encode(msgType, flags, id, length)
+	copy(buf, h[:])
+	copy(buf[headerSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(buf)
+	if err != nil {
+		s.closeWithError(err)
+	}
+	return err
+}
+
+func (s *Session) recvLoop() {
+	var h header
+	for {
+		err := readHeader(s.conn, &h)
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+		s.lastRecv.Store(time.Now().UnixNano())
+		if h.version() != protoVersion {
+			s.closeWithError(ErrProtocol)
+			return
+		}
+
+		switch h.msgType() {
+		case typeData:
+			err = s.handleData(h)
+		case typeWindowUpdate:
+			err = s.handleWindowUpdate(h)
+		case typePing:
+			if h.flags()&flagSYN != 0 {
+				go s.writeFrame(typePing, flagACK, 0, h.length(), nil)
+			}
+		case typeGoAway:
+			err = ErrSessionClosed
+		default:
+			err = ErrProtocol
+		}
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+// stream returns the stream with the given ID, creating it if the frame opens a new stream.
+func (s *Session) stream(h header) (*Stream, error) {
+	id := h.streamID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.streams[id]
+	if h.flags()&flagSYN == 0 {
+		return st, nil
+	}
+	if ok || id%2 == s.nextID%2 {
+		return nil, ErrProtocol
+	}
+
+	st = newStream(s, id)
+	select {
+	case s.accepts <- st:
+		s.streams[id] = st
+	default:
+		// Backlog is full, refuse the stream.
+		go s.writeFrame(typeWindowUpdate, flagRST, id, 0, nil)
+		return nil, nil
+	}
+	return st, nil
+}
+
+func (s *Session) handleData(h header) error {
+	st, err := s.stream(h)
+	if err != nil {
+		return err
+	}
+
+	length := h.length()
+	if length > maxFrameSize {
+		return ErrProtocol
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(s.conn, payload)
+	if err != nil {
+		return err
+	}
+
+	if st == nil {
+		// Data for a closed stream, discard.
+		return nil
+	}
+	return st.recvData(payload, h.flags())
+}
+
+func (s *Session) handleWindowUpdate(h header) error {
+	st, err := s.stream(h)
+	if err != nil || st == nil {
+		return err
+	}
+	st.recvWindowUpdate(h.length(), h.flags())
+	return nil
+}
+
+func (s *Session) keepalive() {
+	interval := s.config.KeepAliveInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var pingID uint32
+	for {
+		select {
+		case <-ticker.C:
+			last := time.Unix(0, s.lastRecv.Load())
+			if time.Since(last) > 3*interval {
+				s.closeWithError(ErrKeepAliveTimeout)
+				return
+			}
+			pingID++
+			s.writeFrame(typePing, flagSYN, 0, pingID, nil)
+		case <-s.closed:
+			return
+		}
+	}
+}
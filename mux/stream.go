@@ -0,0 +1,292 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a logical bidirectional stream inside a multiplexing session.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu            sync.Mutex
+	recvBuf       bytes.Buffer
+	recvWindow    uint32 // remaining window granted to the peer
+	pendingUpdate uint32 // consumed bytes not yet granted back
+	sendWindow    uint32
+	finSent       bool
+	finRecvd      bool
+	reset         bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	recvNotify chan struct{}
+	sendNotify chan struct{}
+}
+
+// Stream implements the net.Conn interface.
+var _ net.Conn = (*Stream)(nil)
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    s,
+		recvWindow: s.config.MaxStreamWindow,
+		sendWindow: s.config.MaxStreamWindow,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream ID.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads data from the stream.
+// It returns io.EOF after the peer closes its side of the stream.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(b)
+			update := st.consume(uint32(n))
+			st.mu.Unlock()
+			if update > 0 {
+				st.session.writeFrame(typeWindowUpdate, 0, st.id, update, nil)
+			}
+			return n, nil
+		}
+		if st.reset {
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		}
+		if st.finRecvd {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		err := st.wait(st.recvNotify, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// consume accounts the consumed bytes and returns the window update
+// that should be sent to the peer, if any.
+func (st *Stream) consume(n uint32) uint32 {
+	st.pendingUpdate += n
+	if st.pendingUpdate < st.session.config.MaxStreamWindow/2 {
+		return 0
+	}
+	update := st.pendingUpdate
+	st.recvWindow += update
+	st.pendingUpdate = 0
+	return update
+}
+
+// Write writes data to the stream, blocking while the peer window is full.
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.mu.Lock()
+		if st.reset {
+			st.mu.Unlock()
+			return written, ErrStreamReset
+		}
+		if st.finSent {
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			err := st.wait(st.sendNotify, deadline)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		n := uint32(len(b) - written)
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		err := st.session.writeFrame(typeData, 0, st.id, n, b[written:written+int(n)])
+		if err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+// wait blocks until the given channel is notified, the deadline passes or the session ends.
+func (st *Stream) wait(notify chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.closed:
+		return st.session.err()
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Close half-closes the stream, no more data can be written but the
+// remaining data sent by the peer can still be read.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.finSent || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecvd
+	st.mu.Unlock()
+
+	err := st.session.writeFrame(typeWindowUpdate, flagFIN, st.id, 0, nil)
+	if done {
+		st.session.removeStream(st.id)
+	}
+	notify(st.sendNotify)
+	return err
+}
+
+// Reset closes the stream immediately in both directions.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	if st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.reset = true
+	st.mu.Unlock()
+
+	st.session.removeStream(st.id)
+	notify(st.recvNotify)
+	notify(st.sendNotify)
+	return st.session.writeFrame(typeWindowUpdate, flagRST, st.id, 0, nil)
+}
+
+func (st *Stream) recvData(payload []byte, flags uint16) error {
+	st.mu.Lock()
+	if uint32(len(payload)) > st.recvWindow {
+		st.mu.Unlock()
+		return ErrProtocol
+	}
+	st.recvWindow -= uint32(len(payload))
+	if !st.reset {
+		st.recvBuf.Write(payload)
+	}
+	st.mu.Unlock()
+
+	st.handleFlags(flags)
+	notify(st.recvNotify)
+	return nil
+}
+
+func (st *Stream) recvWindowUpdate(delta uint32, flags uint16) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+
+	st.handleFlags(flags)
+	notify(st.sendNotify)
+}
+
+func (st *Stream) handleFlags(flags uint16) {
+	if flags&(flagFIN|flagRST) == 0 {
+		return
+	}
+
+	st.mu.Lock()
+	remove := false
+	if flags&flagRST != 0 {
+		st.reset = true
+		remove = true
+	}
+	if flags&flagFIN != 0 {
+		st.finRecvd = true
+		remove = remove || st.finSent
+	}
+	st.mu.Unlock()
+
+	if remove {
+		st.session.removeStream(st.id)
+	}
+	notify(st.recvNotify)
+	notify(st.sendNotify)
+}
+
+// SetDeadline sets the read and write deadlines of the stream.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the stream.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.recvNotify)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the stream.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.sendNotify)
+	return nil
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (st *Stream) LocalAddr() net.Addr {
+	if c, ok := st.session.conn.(net.Conn); ok {
+		return c.LocalAddr()
+	}
+	return nil
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (st *Stream) RemoteAddr() net.Addr {
+	if c, ok := st.session.conn.(net.Conn); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package qsocket
+
+import (
+	"errors"
+	"io"
+)
+
+// Built-in key exchange names.
+const (
+	// KEY_EXCHANGE_CPACE is the balanced CPace key exchange over ristretto255.
+	KEY_EXCHANGE_CPACE = "cpace-ristretto255"
+	// KEY_EXCHANGE_SRP is the SRP-6a key exchange with a 4096 bit group.
+	KEY_EXCHANGE_SRP = "srp-4096"
+)
+
+var (
+	ErrUnsupportedKeyExchange = errors.New("Unsupported key exchange.")
+	ErrNoCommonKeyExchange    = errors.New("No common key exchange with peer.")
+)
+
+// DefaultKeyExchanges is the default key exchange preference order.
+var DefaultKeyExchanges = []string{KEY_EXCHANGE_CPACE, KEY_EXCHANGE_SRP}
+
+// KeyExchange is a password authenticated key exchange (PAKE)
+// performed between the peers for establishing the E2E session key.
+type KeyExchange interface {
+	// Name returns the unique name of the key exchange used in the negotiation.
+	Name() string
+	// Exchange performs the key exchange with the peer over rw
+	// and returns the shared session key derived from the secret.
+	Exchange(rw io.ReadWriter, sType SocketType, secret []byte) ([]byte, error)
+}
+
+// NewKeyExchange returns the built-in key exchange with the given name.
+func NewKeyExchange(name string) (KeyExchange, error) {
+	switch name {
+	case KEY_EXCHANGE_CPACE:
+		return cpaceKeyExchange{}, nil
+	case KEY_EXCHANGE_SRP:
+		return srpKeyExchange{}, nil
+	default:
+		return nil, ErrUnsupportedKeyExchange
+	}
+}
+
+// SetKeyExchanges sets the key exchanges offered by the socket in preference order.
+// It overrides Config.KeyExchanges and allows using custom implementations.
+func (qs *QSocket) SetKeyExchanges(kxs ...KeyExchange) error {
+	if !qs.IsClosed() {
+		return ErrSocketInUse
+	}
+
+	qs.keyExchanges = kxs
+	return nil
+}
+
+// KeyExchangeName returns the name of the negotiated key exchange,
+// or an empty string if no key exchange is performed yet.
+func (qs *QSocket) KeyExchangeName() string {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+	return qs.kxName
+}
+
+// supportedKeyExchanges returns the key exchanges offered by the socket.
+func (qs *QSocket) supportedKeyExchanges() ([]KeyExchange, error) {
+	if qs.keyExchanges != nil {
+		return qs.keyExchanges, nil
+	}
+	names := qs.config.KeyExchanges
+	if names == nil {
+		names = DefaultKeyExchanges
+	}
+	kxs := make([]KeyExchange, 0, len(names))
+	for _, name := range names {
+		kx, err := NewKeyExchange(name)
+		if err != nil {
+			return nil, err
+		}
+		kxs = append(kxs, kx)
+	}
+	return kxs, nil
+}
+
+// InitKeyExchange negotiates the key exchange and the cipher suite with the
+// peer and performs the key exchange for establishing the E2E session key.
+// The handshake transcript is recorded for the E2E key schedule.
+func (qs *QSocket) InitKeyExchange() ([]byte, error) {
+	if qs.IsClosed() {
+		return nil, ErrSocketNotConnected
+	}
+
+	kxs, err := qs.supportedKeyExchanges()
+	if err != nil {
+		return nil, err
+	}
+	t := newTranscript(qs, qs.socketType)
+	kx, suite, err := negotiate(t, qs.socketType, kxs, qs.config.cipherSuites())
+	if err != nil {
+		return nil, err
+	}
+	qs.mu.Lock()
+	qs.kxName = kx.Name()
+	qs.cipherSuite = suite
+	qs.mu.Unlock()
+	qs.logf("Using %s key exchange with %s", kx.Name(), suite)
+	key, err := kx.Exchange(t, qs.socketType, qs.secretKeys().pakeSecret)
+	if err != nil {
+		return nil, err
+	}
+	qs.mu.Lock()
+	qs.transcriptHash = t.Sum()
+	qs.mu.Unlock()
+	return key, nil
+}
+
+// srpKeyExchange is the SRP-6a key exchange, the client authenticates
+// against a verifier the server derives from the secret.
+type srpKeyExchange struct{}
+
+func (srpKeyExchange) Name() string {
+	return KEY_EXCHANGE_SRP
+}
+
+func (srpKeyExchange) Exchange(rw io.ReadWriter, sType SocketType, secret []byte) ([]byte, error) {
+	if sType == Client {
+		return srpClient(rw, secret)
+	}
+	return srpServer(rw, secret)
+}
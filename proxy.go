@@ -0,0 +1,327 @@
+package qsocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	ErrInvalidProxyURL      = errors.New("Invalid proxy URL.")
+	ErrUnsupportedProxy     = errors.New("Unsupported proxy scheme.")
+	ErrProxyConnectFailed   = errors.New("HTTP proxy CONNECT failed.")
+	ErrProxyResponseTooLong = errors.New("HTTP proxy response header too long.")
+)
+
+const (
+	// maxProxyResponseSize is the max size of a CONNECT response of HTTP proxies.
+	maxProxyResponseSize = 16 * 1024
+	// maxProxyAuthRounds is the max number of answered authentication challenges of a proxy.
+	maxProxyAuthRounds = 4
+)
+
+// ProxyAuthenticator answers the authentication challenges of HTTP proxies, e.g. for
+// NTLM or Negotiate authentication. It is called with every `407 Proxy Authentication
+// Required` response and returns the `Proxy-Authorization` value of the next CONNECT
+// request, which is sent over the same connection. Returning an error aborts the dial.
+type ProxyAuthenticator func(challenge *http.Response) (string, error)
+
+// SetProxyDialer sets a custom dialer used for reaching the gate,
+// e.g. a proxy implementation that is not supported by SetProxy.
+func (qs *QSocket) SetProxyDialer(d proxy.ContextDialer) error {
+	if !qs.IsClosed() {
+		return ErrSocketInUse
+	}
+
+	qs.proxyDialer = forwardDialer{d}
+	qs.config.Proxy = ""
+	qs.config.ProxyChain = nil
+	return nil
+}
+
+// gateDialer returns the proxy dialer, if any, and the gate address for the dial sequence.
+func (qs *QSocket) gateDialer(port int) (proxy.Dialer, string, error) {
+	if qs.config.Tor != nil {
+		dialer, err := qs.torDialer()
+		if err != nil {
+			return nil, "", err
+		}
+		return dialer, net.JoinHostPort(qs.config.torGate(), strconv.Itoa(port)), nil
+	}
+
+	addr := net.JoinHostPort(qs.config.Gate, strconv.Itoa(port))
+	dialer, err := qs.upstreamDialer(addr)
+	if err != nil {
+		return nil, "", err
+	}
+	return dialer, addr, nil
+}
+
+// upstreamDialer returns the dialer of the proxies used for reaching addr,
+// or nil for direct connections. A custom proxy dialer takes precedence over
+// the configured proxies, which take precedence over the environment.
+func (qs *QSocket) upstreamDialer(addr string) (proxy.Dialer, error) {
+	if qs.proxyDialer != nil {
+		return qs.proxyDialer, nil
+	}
+
+	hops, err := qs.proxyChainFor(addr)
+	if err != nil || len(hops) == 0 {
+		return nil, err
+	}
+	return newProxyChain(hops, qs.netDialer())
+}
+
+// netDialer returns the dialer for direct connections.
+func (qs *QSocket) netDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   qs.config.DialTimeout,
+		KeepAlive: 10 * time.Second,
+	}
+}
+
+// parseProxyURL parses the proxy URL, plain `host:port` addresses are SOCKS5 proxies.
+func parseProxyURL(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "socks5h://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Hostname() == "" {
+		return nil, ErrInvalidProxyURL
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, ErrUnsupportedProxy
+	}
+	return u, nil
+}
+
+// newProxyDialer returns the dialer for the proxy of the given URL,
+// the proxy itself is reached through the forward dialer.
+func newProxyDialer(u *url.URL, header http.Header, auth ProxyAuthenticator, forward proxy.Dialer) (proxy.Dialer, error) {
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+		}
+		d, err := proxy.SOCKS5("tcp", proxyHostPort(u), auth, forward)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "socks5" {
+			// Unlike socks5h, host names are resolved locally.
+			return &resolvingDialer{d.(proxy.ContextDialer)}, nil
+		}
+		return d, nil
+	case "http", "https":
+		return &httpProxyDialer{proxyURL: u, header: header, auth: auth, forward: forward}, nil
+	default:
+		return nil, ErrUnsupportedProxy
+	}
+}
+
+// proxyHostPort returns the address of the proxy with the default port of its scheme.
+func proxyHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "http":
+		return net.JoinHostPort(u.Hostname(), "80")
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	default:
+		return net.JoinHostPort(u.Hostname(), "1080")
+	}
+}
+
+// environmentProxy returns the proxy URL for reaching the given gate address from
+// the HTTPS_PROXY and ALL_PROXY environment variables, or nil if NO_PROXY excludes it.
+func environmentProxy(addr string) (*url.URL, error) {
+	raw := getenvAny("HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy")
+	if raw == "" {
+		return nil, nil
+	}
+	// httpproxy only knows http and socks5 proxies, it is used for matching NO_PROXY.
+	cfg := &httpproxy.Config{
+		HTTPSProxy: "http://proxy",
+		NoProxy:    getenvAny("NO_PROXY", "no_proxy"),
+	}
+	u, err := cfg.ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+	if err != nil || u == nil {
+		return nil, err
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	return parseProxyURL(raw)
+}
+
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// forwardDialer adapts a proxy.ContextDialer to proxy.Dialer.
+type forwardDialer struct {
+	proxy.ContextDialer
+}
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// resolvingDialer resolves host names locally before dialing through the proxy.
+type resolvingDialer struct {
+	proxy.ContextDialer
+}
+
+func (d *resolvingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(ips[0].String(), port)
+	}
+	return d.ContextDialer.DialContext(ctx, network, addr)
+}
+
+// httpProxyDialer dials through an HTTP(S) proxy with the CONNECT method.
+type httpProxyDialer struct {
+	proxyURL *url.URL
+	header   http.Header
+	auth     ProxyAuthenticator
+	forward  proxy.Dialer
+}
+
+func (d *httpProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (_ net.Conn, err error) {
+	conn, err := dialProxyContext(ctx, d.forward, "tcp", proxyHostPort(d.proxyURL))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	stop := watchContext(ctx, conn)
+	defer stop()
+
+	if d.proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxyURL.Hostname()})
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	header := d.header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if u := d.proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+
+	lr := &limitedReader{r: conn}
+	br := bufio.NewReaderSize(lr, 1024)
+	for round := 0; ; round++ {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: header,
+		}
+		err = req.Write(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		lr.n = maxProxyResponseSize
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusProxyAuthRequired && d.auth != nil && round < maxProxyAuthRounds && !resp.Close {
+			// The challenge is answered over the same connection, after the response body.
+			_, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			answer, err := d.auth(resp)
+			if err != nil {
+				return nil, err
+			}
+			header = header.Clone()
+			header.Set("Proxy-Authorization", answer)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%w (%s)", ErrProxyConnectFailed, resp.Status)
+		}
+		break
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, br: br}, nil
+	}
+	return conn, nil
+}
+
+// limitedReader limits the size of the proxy responses, it returns
+// ErrProxyResponseTooLong instead of io.EOF after n bytes.
+type limitedReader struct {
+	r io.Reader
+	n int
+}
+
+func (l *limitedReader) Read(b []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, ErrProxyResponseTooLong
+	}
+	if len(b) > l.n {
+		b = b[:l.n]
+	}
+	n, err := l.r.Read(b)
+	l.n -= n
+	return n, err
+}
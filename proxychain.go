@@ -0,0 +1,171 @@
+package qsocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var (
+	ErrInvalidProxyHop = errors.New("Invalid proxy chain hop.")
+	ErrProxyConflict   = errors.New("Proxy and ProxyChain can not be used together.")
+)
+
+// ProxyHop is a single proxy of a proxy chain.
+type ProxyHop struct {
+	// URL is the proxy URL, see Config.Proxy for the supported schemes.
+	URL string `json:"url"`
+	// Header contains extra headers sent with the CONNECT request of HTTP proxies.
+	Header http.Header `json:"header"`
+	// Authenticator answers the authentication challenges of HTTP proxies.
+	Authenticator ProxyAuthenticator `json:"-"`
+	// Timeout bounds establishing the connection through this hop,
+	// including the previous hops. Zero means no timeout.
+	Timeout time.Duration `json:"timeout"`
+}
+
+// Validate checks whether the proxy hop values are valid.
+func (h *ProxyHop) Validate() error {
+	if h.Timeout < 0 {
+		return ErrInvalidProxyHop
+	}
+	_, err := parseProxyURL(h.URL)
+	return err
+}
+
+// ProxyError is a failure of a proxy hop, Hop is the index of the failing hop in the chain.
+// A single proxy set with Config.Proxy or found in the environment is hop zero.
+type ProxyError struct {
+	// Hop is the index of the failing hop.
+	Hop int
+	// URL is the URL of the failing hop, without the password.
+	URL string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy hop %d (%s): %s", e.Hop, e.URL, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// SetProxyChain sets the chain of proxies used for reaching the gate. The first hop
+// is dialed directly and every following hop is reached through the previous one.
+func (qs *QSocket) SetProxyChain(hops ...ProxyHop) error {
+	if !qs.IsClosed() {
+		return ErrSocketInUse
+	}
+
+	for i := range hops {
+		err := hops[i].Validate()
+		if err != nil {
+			return err
+		}
+	}
+	qs.proxyDialer = nil
+	qs.config.Proxy = ""
+	qs.config.ProxyChain = cloneProxyChain(hops)
+	return nil
+}
+
+// newProxyChain returns the dialer of the last hop of the chain,
+// the first hop is reached through the forward dialer.
+func newProxyChain(hops []ProxyHop, forward proxy.Dialer) (proxy.Dialer, error) {
+	for i, hop := range hops {
+		u, err := parseProxyURL(hop.URL)
+		if err != nil {
+			return nil, err
+		}
+		dialer, err := newProxyDialer(u, hop.Header, hop.Authenticator, forward)
+		if err != nil {
+			return nil, err
+		}
+		forward = &hopDialer{
+			hop:     i,
+			url:     u.Redacted(),
+			timeout: hop.Timeout,
+			dialer:  dialer,
+		}
+	}
+	return forward, nil
+}
+
+// hopDialer applies the timeout of a proxy hop and reports its failures as ProxyError.
+type hopDialer struct {
+	hop     int
+	url     string
+	timeout time.Duration
+	dialer  proxy.Dialer
+}
+
+func (d *hopDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *hopDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	hctx := ctx
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		hctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	conn, err := dialProxyContext(hctx, d.dialer, network, addr)
+	if err != nil {
+		// Failures of the previous hops are already reported, unless this hop timed out.
+		// The connection deadline set from the context may fire before the context itself.
+		var pe *ProxyError
+		deadline, ok := hctx.Deadline()
+		timedOut := d.timeout > 0 && ok && !time.Now().Before(deadline) && ctx.Err() == nil
+		if timedOut || !errors.As(err, &pe) {
+			if timedOut {
+				err = context.DeadlineExceeded
+			}
+			err = &ProxyError{Hop: d.hop, URL: d.url, Err: err}
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func cloneProxyChain(hops []ProxyHop) []ProxyHop {
+	if hops == nil {
+		return nil
+	}
+	clone := make([]ProxyHop, len(hops))
+	for i, hop := range hops {
+		hop.Header = hop.Header.Clone()
+		clone[i] = hop
+	}
+	return clone
+}
+
+// proxyChainFor returns the proxy chain for reaching addr from the config or the environment,
+// a single proxy is a chain of one hop.
+func (qs *QSocket) proxyChainFor(addr string) ([]ProxyHop, error) {
+	switch {
+	case len(qs.config.ProxyChain) > 0:
+		return qs.config.ProxyChain, nil
+	case qs.config.Proxy != "":
+		return []ProxyHop{{
+			URL:           qs.config.Proxy,
+			Header:        qs.config.ProxyHeader,
+			Authenticator: qs.config.ProxyAuthenticator,
+		}}, nil
+	case qs.config.ProxyFromEnvironment:
+		u, err := environmentProxy(addr)
+		if err != nil || u == nil {
+			return nil, err
+		}
+		return []ProxyHop{{URL: u.String(), Authenticator: qs.config.ProxyAuthenticator}}, nil
+	}
+	return nil, nil
+}
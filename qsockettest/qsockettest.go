@@ -0,0 +1,250 @@
+// Package qsockettest provides utilities for QSocket testing.
+//
+// It spins up an in-process QSRN relay on the loopback interface with a
+// self-signed certificate, so that the whole dial sequence (knock, TLS,
+// pinning and SRP) can be tested hermetically.
+//
+//	r := qsockettest.NewRelay()
+//	defer r.Close()
+//	client, server, err := r.DialPair(ctx, "my-secret", true)
+package qsockettest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	qsocket "github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/relay"
+)
+
+// ServerName is the TLS server name of the test relay certificate.
+const ServerName = "relay.qsocket.test"
+
+// A Relay is a QSRN relay listening on a system-chosen port on the
+// local loopback interface, for use in end-to-end tests.
+type Relay struct {
+	*relay.Server
+	// Addr is the plain TCP address of the relay.
+	Addr string
+	// TLSAddr is the TLS address of the relay.
+	TLSAddr string
+	// Certificate is the TLS certificate of the relay, self-signed by default.
+	Certificate *x509.Certificate
+	// CertFingerprint is the hex encoded SHA256 fingerprint of the relay certificate.
+	CertFingerprint string
+	// TLSConfig optionally configures the TLS listener of an unstarted relay,
+	// e.g. for requiring client certificates. A self-signed relay certificate
+	// is set on Start, unless TLSConfig has its own certificate chain.
+	TLSConfig *tls.Config
+}
+
+// NewRelay starts and returns a new Relay.
+// The caller should call Close when finished, to shut it down.
+// It panics on failure, like `httptest.NewServer`.
+func NewRelay() *Relay {
+	return NewUnstartedRelay().Start()
+}
+
+// NewUnstartedRelay returns a new Relay that is not started yet,
+// the relay server can be configured before calling Start.
+func NewUnstartedRelay() *Relay {
+	return &Relay{Server: &relay.Server{}}
+}
+
+// Start starts the relay listeners.
+func (r *Relay) Start() *Relay {
+	var cert tls.Certificate
+	var err error
+	if r.TLSConfig != nil && len(r.TLSConfig.Certificates) > 0 {
+		cert = r.TLSConfig.Certificates[0]
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+	} else {
+		cert, err = newSelfSignedCert(x509.ExtKeyUsageServerAuth)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("qsockettest: failed loading certificate: %v", err))
+	}
+	r.Certificate = cert.Leaf
+	h := sha256.Sum256(cert.Leaf.Raw)
+	r.CertFingerprint = hex.EncodeToString(h[:])
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("qsockettest: failed to listen: %v", err))
+	}
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		l.Close()
+		panic(fmt.Sprintf("qsockettest: failed to listen: %v", err))
+	}
+	r.Addr = l.Addr().String()
+	r.TLSAddr = tl.Addr().String()
+
+	tlsConfig := &tls.Config{}
+	if r.TLSConfig != nil {
+		tlsConfig = r.TLSConfig.Clone()
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	go r.Serve(l)
+	go r.Serve(tls.NewListener(tl, tlsConfig))
+	return r
+}
+
+// Config returns a socket configuration pointing at the relay,
+// with the relay certificate fingerprint pinned.
+func (r *Relay) Config() *qsocket.Config {
+	cfg := qsocket.DefaultConfig()
+	cfg.Gate = "127.0.0.1"
+	cfg.Port = port(r.Addr)
+	cfg.TLSPort = port(r.TLSAddr)
+	cfg.ServerName = ServerName
+	cfg.Host = ServerName
+	cfg.CertFingerprint = r.CertFingerprint
+	return cfg
+}
+
+// CertPool returns a certificate pool containing the relay certificate,
+// for dialing the relay in the qsocket.TLS_VERIFY_CA mode.
+func (r *Relay) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(r.Certificate)
+	return pool
+}
+
+// NewPair returns a new client and server socket pair with the given secret,
+// configured for the relay but not dialed yet.
+func (r *Relay) NewPair(secret string) (client, server *qsocket.QSocket, err error) {
+	return r.NewPairWithConfig(secret, r.Config())
+}
+
+// NewPairWithConfig is like NewPair but uses the given configuration.
+func (r *Relay) NewPairWithConfig(secret string, cfg *qsocket.Config) (client, server *qsocket.QSocket, err error) {
+	client, err = qsocket.NewSocketWithConfig(qsocket.Client, secret, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err = qsocket.NewSocketWithConfig(qsocket.Server, secret, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// DialPair creates a new socket pair with the given secret and dials both of them.
+func (r *Relay) DialPair(ctx context.Context, secret string, useTls bool) (client, server *qsocket.QSocket, err error) {
+	client, server, err = r.NewPair(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = DialSockets(ctx, client, server, useTls)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// DialSockets dials the given client and server sockets concurrently.
+// The client is redialed until the server registers on the relay.
+func DialSockets(ctx context.Context, client, server *qsocket.QSocket, useTls bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	srvErr := make(chan error, 1)
+	go func() { srvErr <- server.DialContext(ctx, useTls) }()
+
+	cliErr := dialClient(ctx, client, useTls)
+	if cliErr != nil {
+		cancel()
+	}
+	err := <-srvErr
+	if cliErr != nil {
+		return cliErr
+	}
+	if err != nil {
+		client.Close()
+	}
+	return err
+}
+
+func dialClient(ctx context.Context, client *qsocket.QSocket, useTls bool) error {
+	for {
+		err := client.DialContext(ctx, useTls)
+		if !errors.Is(err, qsocket.ErrPeerNotFound) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func port(addr string) int {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	return tcpAddr.Port
+}
+
+// NewClientCertificate returns a new self-signed client certificate,
+// its leaf can be added to the ClientCAs pool of the relay TLSConfig.
+func NewClientCertificate() (tls.Certificate, error) {
+	return newSelfSignedCert(x509.ExtKeyUsageClientAuth)
+}
+
+func newSelfSignedCert(usage x509.ExtKeyUsage) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"QSocket Test Relay"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{ServerName},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
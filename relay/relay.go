@@ -0,0 +1,389 @@
+// Package relay implements the gate side of the QSRN knock protocol.
+//
+// A relay accepts knock requests from QSocket peers, tells servers from
+// clients using the checksum URI, pairs peers by the UID carried in the
+// `Sec-WebSocket-Key` header and splices the paired streams together.
+// Peers requesting the `qsocket` websocket sub-protocol get RFC 6455
+// framing, which is translated when paired with a raw peer.
+//
+//	srv := &relay.Server{}
+//	go srv.ListenAndServe(":80")
+//	srv.ListenAndServeTLS(":443", tlsConfig)
+package relay
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	qsocket "github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/internal/websocket"
+)
+
+// DefaultKnockTimeout is the default time limit for receiving a knock request.
+const DefaultKnockTimeout = 10 * time.Second
+
+var (
+	ErrServerClosed = errors.New("Relay server closed.")
+	ErrInvalidKnock = errors.New("Invalid knock request.")
+)
+
+// Server is a QSRN relay server.
+// The zero value is a valid relay with default settings.
+type Server struct {
+	// KnockTimeout bounds reading the knock request, zero means DefaultKnockTimeout.
+	KnockTimeout time.Duration
+	// RequireUpgrade is consulted for every knock request, returning a
+	// non-empty message rejects the peer with `426 Upgrade Required`
+	// and the message as the response body.
+	RequireUpgrade func(r *http.Request) string
+	// Logger receives debug messages, nil disables logging.
+	Logger qsocket.Logger
+
+	mu        sync.Mutex
+	servers   map[string]*peer
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// peer represents a knocked peer connection.
+type peer struct {
+	net.Conn
+	br     *bufio.Reader
+	key    string
+	framed bool // peer uses websocket framing
+	pair   chan *peer
+}
+
+// Read reads from the buffered reader first for not losing any buffered bytes.
+func (p *peer) Read(b []byte) (int, error) {
+	return p.br.Read(b)
+}
+
+// ListenAndServe listens on the TCP network address addr and serves plain TCP peers.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS listens on the TCP network address addr and serves TLS peers.
+func (s *Server) ListenAndServeTLS(addr string, config *tls.Config) error {
+	l, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts incoming connections on the listener l and handles
+// each knock in a new goroutine. Serve always returns a non-nil error
+// and closes l, after Close the returned error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, true) {
+		return ErrServerClosed
+	}
+	defer s.track(l, false)
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Close closes all active listeners and peer connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.listeners = nil
+	s.conns = nil
+	s.servers = nil
+	return nil
+}
+
+// CloseConns closes all active peer connections while keeping the listeners open.
+func (s *Server) CloseConns() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// track adds or removes the given listener or connection to the active set.
+func (s *Server) track(v any, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add && s.closed {
+		return false
+	}
+
+	switch v := v.(type) {
+	case net.Listener:
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		if add {
+			s.listeners[v] = struct{}{}
+		} else {
+			delete(s.listeners, v)
+		}
+	case net.Conn:
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]struct{})
+		}
+		if add {
+			s.conns[v] = struct{}{}
+		} else {
+			delete(s.conns, v)
+		}
+	}
+	return true
+}
+
+func (s *Server) logf(format string, v ...any) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	if !s.track(conn, true) {
+		conn.Close()
+		return
+	}
+
+	p, sType, err := s.readKnock(conn)
+	if err != nil {
+		s.logf("%s: %s", conn.RemoteAddr(), err)
+		s.closeConn(conn)
+		return
+	}
+
+	switch sType {
+	case qsocket.Server:
+		s.handleServer(p)
+	case qsocket.Client:
+		s.handleClient(p)
+	}
+}
+
+func (s *Server) closeConn(conn net.Conn) {
+	conn.Close()
+	s.track(conn, false)
+}
+
+// readKnock reads and validates the knock request of the given connection.
+// Invalid requests are answered with the appropriate HTTP error response.
+func (s *Server) readKnock(conn net.Conn) (*peer, qsocket.SocketType, error) {
+	timeout := s.KnockTimeout
+	if timeout == 0 {
+		timeout = DefaultKnockTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		writeResponse(conn, http.StatusBadRequest, "")
+		return nil, 0, err
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	uid, err := base64.StdEncoding.DecodeString(key)
+	if err != nil ||
+		len(uid) != 16 ||
+		req.Method != http.MethodGet ||
+		!strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		writeResponse(conn, http.StatusBadRequest, "")
+		return nil, 0, ErrInvalidKnock
+	}
+
+	if s.RequireUpgrade != nil {
+		msg := s.RequireUpgrade(req)
+		if msg != "" {
+			writeResponse(conn, http.StatusUpgradeRequired, msg)
+			return nil, 0, qsocket.ErrUpgradeRequired
+		}
+	}
+
+	sType := qsocket.SocketType(qsocket.CalcChecksum(
+		[]byte(strings.TrimPrefix(req.URL.Path, "/")),
+		qsocket.CHECKSUM_BASE,
+	))
+	switch sType {
+	case qsocket.Server, qsocket.Client:
+	default:
+		writeResponse(conn, http.StatusBadRequest, "")
+		return nil, 0, qsocket.ErrUnexpectedSocket
+	}
+
+	return &peer{
+		Conn:   conn,
+		br:     br,
+		key:    key,
+		framed: hasProtocol(req, qsocket.WEBSOCKET_PROTOCOL),
+		pair:   make(chan *peer, 1),
+	}, sType, nil
+}
+
+// handleServer registers the server peer and waits for a client with the same UID.
+func (s *Server) handleServer(srv *peer) {
+	s.mu.Lock()
+	if s.servers == nil {
+		s.servers = make(map[string]*peer)
+	}
+	if _, ok := s.servers[srv.key]; ok || s.closed {
+		s.mu.Unlock()
+		writeResponse(srv, http.StatusConflict, "")
+		s.closeConn(srv.Conn)
+		return
+	}
+	s.servers[srv.key] = srv
+	s.mu.Unlock()
+	s.logf("%s: server registered", srv.RemoteAddr())
+
+	// Watch the idle server connection for disconnects.
+	gone := make(chan struct{})
+	go func() {
+		srv.br.Peek(1)
+		close(gone)
+	}()
+
+	select {
+	case cli := <-srv.pair:
+		// Interrupt the watcher and clear the deadline.
+		srv.SetReadDeadline(time.Unix(1, 0))
+		<-gone
+		srv.SetReadDeadline(time.Time{})
+		s.splice(srv, cli)
+	case <-gone:
+		s.mu.Lock()
+		if s.servers[srv.key] == srv {
+			delete(s.servers, srv.key)
+		}
+		s.mu.Unlock()
+		// A client may have been paired right before the server left.
+		select {
+		case cli := <-srv.pair:
+			writeResponse(cli, http.StatusNotFound, "")
+			s.closeConn(cli.Conn)
+		default:
+		}
+		s.logf("%s: server left", srv.RemoteAddr())
+		s.closeConn(srv.Conn)
+	}
+}
+
+// handleClient pairs the client peer with the waiting server with the same UID.
+func (s *Server) handleClient(cli *peer) {
+	s.mu.Lock()
+	srv, ok := s.servers[cli.key]
+	if ok {
+		delete(s.servers, cli.key)
+		srv.pair <- cli
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeResponse(cli, http.StatusNotFound, "")
+		s.closeConn(cli.Conn)
+	}
+}
+
+// splice completes the protocol switch of both peers and binds their streams.
+func (s *Server) splice(srv, cli *peer) {
+	defer s.closeConn(srv.Conn)
+	defer s.closeConn(cli.Conn)
+
+	s.logf("%s <-> %s: peers paired", srv.RemoteAddr(), cli.RemoteAddr())
+	if writeSwitchingProtocols(srv) != nil ||
+		writeSwitchingProtocols(cli) != nil {
+		return
+	}
+	err := qsocket.BindStreams(srv.stream(), cli.stream())
+	s.logf("%s <-> %s: %s", srv.RemoteAddr(), cli.RemoteAddr(), err)
+}
+
+// stream returns the raw data stream of the peer, unwrapping websocket frames if needed.
+func (p *peer) stream() net.Conn {
+	if p.framed {
+		return websocket.NewConn(p, false, 0)
+	}
+	return p
+}
+
+// hasProtocol checks if the given sub-protocol is requested in the `Sec-WebSocket-Protocol` header.
+func hasProtocol(req *http.Request, protocol string) bool {
+	for _, v := range req.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if strings.TrimSpace(p) == protocol {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeSwitchingProtocols(p *peer) error {
+	resp := "HTTP/1.1 101 Switching Protocols" + qsocket.CRLF
+	resp += "Upgrade: websocket" + qsocket.CRLF
+	resp += "Connection: Upgrade" + qsocket.CRLF
+	if p.framed {
+		resp += fmt.Sprintf("Sec-WebSocket-Protocol: %s", qsocket.WEBSOCKET_PROTOCOL) + qsocket.CRLF
+	}
+	resp += fmt.Sprintf("Sec-WebSocket-Accept: %s", qsocket.WebsocketAcceptKey(p.key))
+	resp += (qsocket.CRLF + qsocket.CRLF)
+	_, err := p.Write([]byte(resp))
+	return err
+}
+
+func writeResponse(conn net.Conn, status int, body string) error {
+	resp := fmt.Sprintf("HTTP/1.1 %d %s", status, http.StatusText(status)) + qsocket.CRLF
+	resp += "Content-Type: text/plain" + qsocket.CRLF
+	resp += fmt.Sprintf("Content-Length: %d", len(body)) + qsocket.CRLF
+	resp += "Connection: close"
+	resp += (qsocket.CRLF + qsocket.CRLF)
+	resp += body
+	_, err := conn.Write([]byte(resp))
+	return err
+}
@@ -0,0 +1,666 @@
+package qsocket
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Resume protocol version.
+	resumeVersion byte = 1
+	// Resume frame types.
+	resumeData  byte = 0
+	resumeAck   byte = 1
+	resumeClose byte = 2
+	// resumeMaxChunk is the max payload size of a single resume data frame.
+	resumeMaxChunk = 32 * 1024
+	// resumeAckInterval is the max delay of acknowledging the received data.
+	resumeAckInterval = 250 * time.Millisecond
+	// resumeHelloTimeout bounds the resume handshake on a new connection.
+	resumeHelloTimeout = 30 * time.Second
+)
+
+var (
+	ErrResumeFailed       = errors.New("QSocket session resumption failed.")
+	ErrResumeMismatch     = errors.New("QSocket resume session mismatch.")
+	ErrReconnectExhausted = errors.New("QSocket reconnect attempts exhausted.")
+	ErrInvalidReconnect   = errors.New("Invalid reconnect config.")
+)
+
+// ReconnectConfig configures the reconnect behaviour of a ResilientSocket.
+type ReconnectConfig struct {
+	// MinBackoff is the initial delay between reconnect attempts.
+	MinBackoff time.Duration `json:"min_backoff"`
+	// MaxBackoff is the max delay between reconnect attempts.
+	MaxBackoff time.Duration `json:"max_backoff"`
+	// MaxAttempts is the max number of consecutive failed attempts, zero means unlimited.
+	MaxAttempts int `json:"max_attempts"`
+	// Timeout bounds the whole reconnect of a dropped session, zero means no timeout.
+	Timeout time.Duration `json:"timeout"`
+	// BufferSize is the max number of unacknowledged bytes kept for retransmission,
+	// Write blocks while the buffer is full.
+	BufferSize int `json:"buffer_size"`
+}
+
+// DefaultReconnectConfig returns the default reconnect configuration.
+func DefaultReconnectConfig() *ReconnectConfig {
+	return &ReconnectConfig{
+		MinBackoff: 250 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+		Timeout:    2 * time.Minute,
+		BufferSize: 4 * 1024 * 1024,
+	}
+}
+
+// Validate checks whether the reconnect config values are valid.
+func (c *ReconnectConfig) Validate() error {
+	if c.MinBackoff <= 0 ||
+		c.MaxBackoff < c.MinBackoff ||
+		c.MaxAttempts < 0 ||
+		c.Timeout < 0 ||
+		c.BufferSize < resumeMaxChunk {
+		return ErrInvalidReconnect
+	}
+	return nil
+}
+
+// A ResilientSocket is a QSocket session that survives relay connection drops.
+//
+// When the underlying connection fails, the socket redials the relay with backoff,
+// re-pairs with the same secret (which also re-keys the E2E session) and resumes the
+// byte stream from the last acknowledged position, so no data is lost or duplicated.
+// Both peers must use a ResilientSocket, and the session ends only when either peer
+// calls Close or the reconnect attempts are exhausted.
+type ResilientSocket struct {
+	secret     string
+	keys       *secretKeys
+	socketType SocketType
+	config     *Config
+	reconnect  *ReconnectConfig
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	conn       *QSocket
+	sessionID  [16]byte
+	resumed    bool
+	reconnects int
+	// Send state, `sendBuf` holds the unacknowledged bytes starting from `sendBase`.
+	sendBuf  []byte
+	sendBase uint64
+	sendSeq  uint64
+	sentSeq  uint64
+	// Receive state.
+	readBuf   bytes.Buffer
+	recvSeq   uint64
+	ackedRecv uint64
+	ackDue    bool
+	// Lifecycle state.
+	closing       bool
+	closeSent     bool // close frame is sent on the current connection
+	closed        bool
+	peerClosed    bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// ResilientSocket implements the net.Conn interface.
+var _ net.Conn = (*ResilientSocket)(nil)
+
+// NewResilientSocket creates a new ResilientSocket with the given secret and configuration.
+// Reconnect settings are taken from `cfg.Reconnect`, nil means DefaultReconnectConfig.
+func NewResilientSocket(sType SocketType, secret string, cfg *Config) (*ResilientSocket, error) {
+	switch sType {
+	case Client, Server:
+	default:
+		return nil, ErrUnexpectedSocket
+	}
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rs := &ResilientSocket{
+		secret:     secret,
+		keys:       deriveSecretKeys(secret, cfg.uidVersion()),
+		socketType: sType,
+		config:     cfg.Clone(),
+		reconnect:  cfg.reconnectConfig(),
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	rs.cond = sync.NewCond(&rs.mu)
+	if sType == Client {
+		_, err = rand.Read(rs.sessionID[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// Dial dials the relay and establishes the resilient session.
+// The transport is selected by `Config.TLS`.
+func (rs *ResilientSocket) Dial() error {
+	return rs.DialContext(context.Background())
+}
+
+// DialContext is the context aware version of Dial.
+func (rs *ResilientSocket) DialContext(ctx context.Context) error {
+	rs.mu.Lock()
+	if rs.conn != nil || rs.closed {
+		rs.mu.Unlock()
+		return ErrSocketInUse
+	}
+	rs.mu.Unlock()
+
+	qs, err := rs.dial(ctx)
+	if err != nil {
+		return err
+	}
+	err = rs.resume(qs)
+	if err != nil {
+		qs.Close()
+		return err
+	}
+	go rs.supervise(qs)
+	return nil
+}
+
+func (rs *ResilientSocket) dial(ctx context.Context) (*QSocket, error) {
+	qs, err := NewSocketWithConfig(rs.socketType, rs.secret, rs.config)
+	if err != nil {
+		return nil, err
+	}
+	qs.keys = rs.keys
+	err = qs.DialContext(ctx, rs.config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return qs, nil
+}
+
+// resume performs the resume handshake on a new connection and makes it the current one.
+//
+//	| version (1) | session ID (16) | received bytes (8) |
+func (rs *ResilientSocket) resume(qs *QSocket) error {
+	rs.mu.Lock()
+	hello := make([]byte, 25)
+	hello[0] = resumeVersion
+	copy(hello[1:17], rs.sessionID[:])
+	binary.BigEndian.PutUint64(hello[17:], rs.recvSeq)
+	rs.mu.Unlock()
+
+	qs.SetDeadline(time.Now().Add(resumeHelloTimeout))
+	defer qs.SetDeadline(time.Time{})
+	_, err := qs.Write(hello)
+	if err != nil {
+		return err
+	}
+	peerHello := make([]byte, 25)
+	_, err = io.ReadFull(qs, peerHello)
+	if err != nil {
+		return err
+	}
+	if peerHello[0] != resumeVersion {
+		return ErrResumeFailed
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var sid [16]byte
+	copy(sid[:], peerHello[1:17])
+	switch {
+	case rs.sessionID == sid:
+	case !rs.resumed && rs.socketType == Server:
+		// First connection of the server, adopt the session of the client.
+		rs.sessionID = sid
+	case !rs.resumed && sid == [16]byte{}:
+		// First connection of the client, server has no session yet.
+	default:
+		return ErrResumeMismatch
+	}
+
+	peerRecv := binary.BigEndian.Uint64(peerHello[17:])
+	if peerRecv < rs.sendBase || peerRecv > rs.sendSeq {
+		return ErrResumeFailed
+	}
+	rs.trimSendBuf(peerRecv)
+	rs.sentSeq = peerRecv
+	rs.ackDue = rs.recvSeq > rs.ackedRecv
+	rs.resumed = true
+	rs.closeSent = false
+	rs.conn = qs
+	rs.cond.Broadcast()
+	return nil
+}
+
+// supervise runs the current connection and reconnects when it fails.
+func (rs *ResilientSocket) supervise(qs *QSocket) {
+	defer close(rs.done)
+	for {
+		writeDone := make(chan struct{})
+		go func(qs *QSocket) {
+			defer close(writeDone)
+			rs.writeLoop(qs)
+		}(qs)
+		stopAcks := rs.startAckTicker()
+		err := rs.readLoop(qs)
+		stopAcks()
+		qs.Close()
+
+		rs.mu.Lock()
+		rs.conn = nil
+		rs.cond.Broadcast()
+		// Unless the peer has ended the session, a closing session
+		// is resumed for delivering the remaining data and the close frame.
+		finished := rs.peerClosed
+		rs.mu.Unlock()
+		<-writeDone
+
+		if finished {
+			rs.fail(io.EOF)
+			return
+		}
+		if errors.Is(err, ErrResumeFailed) {
+			rs.fail(err)
+			return
+		}
+
+		qs, err = rs.redial()
+		if err != nil {
+			rs.fail(err)
+			return
+		}
+	}
+}
+
+// redial reconnects to the relay with backoff and resumes the session.
+func (rs *ResilientSocket) redial() (*QSocket, error) {
+	ctx := rs.ctx
+	if rs.reconnect.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rs.reconnect.Timeout)
+		defer cancel()
+	}
+
+	backoff := rs.reconnect.MinBackoff
+	for attempt := 1; ; attempt++ {
+		qs, err := rs.dial(ctx)
+		if err == nil {
+			err = rs.resume(qs)
+			if err == nil {
+				rs.mu.Lock()
+				rs.reconnects++
+				rs.mu.Unlock()
+				return qs, nil
+			}
+			qs.Close()
+			if errors.Is(err, ErrResumeFailed) || errors.Is(err, ErrResumeMismatch) {
+				return nil, err
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if rs.reconnect.MaxAttempts > 0 && attempt >= rs.reconnect.MaxAttempts {
+			return nil, ErrReconnectExhausted
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+		if backoff > rs.reconnect.MaxBackoff {
+			backoff = rs.reconnect.MaxBackoff
+		}
+	}
+}
+
+// fail ends the session with the given error.
+func (rs *ResilientSocket) fail(err error) {
+	rs.mu.Lock()
+	if rs.err == nil {
+		rs.err = err
+	}
+	rs.closed = true
+	rs.cond.Broadcast()
+	rs.mu.Unlock()
+	rs.cancel()
+}
+
+// readLoop reads frames from the given connection until it fails.
+//
+//	| type (1) | length (4) | payload |
+func (rs *ResilientSocket) readLoop(qs *QSocket) error {
+	hdr := make([]byte, 5)
+	buf := make([]byte, resumeMaxChunk)
+	for {
+		_, err := io.ReadFull(qs, hdr)
+		if err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(hdr[1:])
+		if length > resumeMaxChunk {
+			return ErrResumeFailed
+		}
+		_, err = io.ReadFull(qs, buf[:length])
+		if err != nil {
+			return err
+		}
+
+		switch hdr[0] {
+		case resumeData:
+			rs.mu.Lock()
+			// Apply backpressure while the application is not reading.
+			for rs.readBuf.Len() >= rs.reconnect.BufferSize && !rs.closed && !rs.closing {
+				rs.cond.Wait()
+			}
+			if !rs.closing {
+				rs.readBuf.Write(buf[:length])
+			}
+			rs.recvSeq += uint64(length)
+			if rs.recvSeq-rs.ackedRecv >= uint64(rs.reconnect.BufferSize/4) {
+				rs.ackDue = true
+			}
+			rs.cond.Broadcast()
+			rs.mu.Unlock()
+		case resumeAck:
+			if length != 8 {
+				return ErrResumeFailed
+			}
+			acked := binary.BigEndian.Uint64(buf[:8])
+			rs.mu.Lock()
+			if acked < rs.sendBase || acked > rs.sentSeq {
+				rs.mu.Unlock()
+				return ErrResumeFailed
+			}
+			rs.trimSendBuf(acked)
+			rs.cond.Broadcast()
+			rs.mu.Unlock()
+		case resumeClose:
+			rs.mu.Lock()
+			rs.peerClosed = true
+			done := rs.closeSent
+			rs.cond.Broadcast()
+			rs.mu.Unlock()
+			if done {
+				return io.EOF
+			}
+			// Keep reading until the write loop answers with a close frame.
+		default:
+			return ErrResumeFailed
+		}
+	}
+}
+
+// writeLoop sends the buffered data and acknowledgements over the given connection.
+func (rs *ResilientSocket) writeLoop(qs *QSocket) {
+	for {
+		rs.mu.Lock()
+		for rs.conn == qs && !rs.ackDue && rs.sentSeq == rs.sendSeq && !rs.closeDue() {
+			rs.cond.Wait()
+		}
+		if rs.conn != qs {
+			rs.mu.Unlock()
+			return
+		}
+
+		var frame []byte
+		switch {
+		case rs.ackDue:
+			frame = make([]byte, 13)
+			frame[0] = resumeAck
+			binary.BigEndian.PutUint32(frame[1:], 8)
+			binary.BigEndian.PutUint64(frame[5:], rs.recvSeq)
+			rs.ackedRecv = rs.recvSeq
+			rs.ackDue = false
+		case rs.sentSeq < rs.sendSeq:
+			start := rs.sentSeq - rs.sendBase
+			n := rs.sendSeq - rs.sentSeq
+			if n > resumeMaxChunk {
+				n = resumeMaxChunk
+			}
+			frame = make([]byte, 5+n)
+			frame[0] = resumeData
+			binary.BigEndian.PutUint32(frame[1:], uint32(n))
+			copy(frame[5:], rs.sendBuf[start:start+n])
+			rs.sentSeq += n
+		default:
+			// Closing and everything is sent.
+			frame = []byte{resumeClose, 0, 0, 0, 0}
+			rs.closeSent = true
+		}
+		peerClosed := rs.peerClosed
+		rs.mu.Unlock()
+
+		_, err := qs.Write(frame)
+		if err != nil || (frame[0] == resumeClose && peerClosed) {
+			// Unblock the read loop, unsent data will be retransmitted after resume.
+			// After answering the close frame of the peer the session is done.
+			qs.Close()
+			return
+		}
+		if frame[0] == resumeClose {
+			// Wait for the close frame of the peer.
+			return
+		}
+	}
+}
+
+// closeDue checks if the close frame should be sent, the lock must be held.
+// Both peers send a close frame, the second one answers the first.
+func (rs *ResilientSocket) closeDue() bool {
+	return (rs.closing || rs.peerClosed) && !rs.closeSent
+}
+
+// startAckTicker periodically acknowledges the received data.
+func (rs *ResilientSocket) startAckTicker() (stop func()) {
+	ticker := time.NewTicker(resumeAckInterval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				rs.mu.Lock()
+				if rs.recvSeq > rs.ackedRecv {
+					rs.ackDue = true
+					rs.cond.Broadcast()
+				}
+				rs.mu.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// trimSendBuf drops the acknowledged bytes from the send buffer.
+func (rs *ResilientSocket) trimSendBuf(acked uint64) {
+	if acked <= rs.sendBase {
+		return
+	}
+	rs.sendBuf = rs.sendBuf[acked-rs.sendBase:]
+	rs.sendBase = acked
+}
+
+// waitLocked waits for a state change or the given deadline, the lock must be held.
+func (rs *ResilientSocket) waitLocked(deadline time.Time) error {
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.AfterFunc(d, func() {
+			rs.mu.Lock()
+			rs.cond.Broadcast()
+			rs.mu.Unlock()
+		})
+		defer t.Stop()
+	}
+	rs.cond.Wait()
+	return nil
+}
+
+// Read reads data from the resilient session.
+func (rs *ResilientSocket) Read(b []byte) (int, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for rs.readBuf.Len() == 0 {
+		if rs.closed || rs.peerClosed {
+			if rs.err != nil && rs.err != io.EOF && !rs.peerClosed {
+				return 0, rs.err
+			}
+			return 0, io.EOF
+		}
+		if !rs.readDeadline.IsZero() && !time.Now().Before(rs.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		err := rs.waitLocked(rs.readDeadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, _ := rs.readBuf.Read(b)
+	rs.cond.Broadcast()
+	return n, nil
+}
+
+// Write writes data to the resilient session. The data is buffered until
+// acknowledged by the peer, Write blocks while the buffer is full.
+func (rs *ResilientSocket) Write(b []byte) (int, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		if rs.closed || rs.closing || rs.peerClosed {
+			if rs.err != nil && rs.err != io.EOF {
+				return written, rs.err
+			}
+			return written, ErrQSocketSessionEnd
+		}
+		space := rs.reconnect.BufferSize - len(rs.sendBuf)
+		if space <= 0 {
+			if !rs.writeDeadline.IsZero() && !time.Now().Before(rs.writeDeadline) {
+				return written, os.ErrDeadlineExceeded
+			}
+			err := rs.waitLocked(rs.writeDeadline)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(b) - written
+		if n > space {
+			n = space
+		}
+		rs.sendBuf = append(rs.sendBuf, b[written:written+n]...)
+		rs.sendSeq += uint64(n)
+		written += n
+		rs.cond.Broadcast()
+	}
+	return written, nil
+}
+
+// Close flushes the buffered data, announces the session end to the peer and
+// closes the underlying connection. Reconnecting sessions are aborted.
+func (rs *ResilientSocket) Close() error {
+	rs.mu.Lock()
+	if rs.closing || rs.closed {
+		rs.mu.Unlock()
+		return nil
+	}
+	rs.closing = true
+	connected := rs.conn != nil
+	rs.cond.Broadcast()
+	rs.mu.Unlock()
+
+	if !connected {
+		rs.fail(io.EOF)
+		return nil
+	}
+
+	// Give the write loop some time for flushing.
+	select {
+	case <-rs.done:
+	case <-time.After(resumeHelloTimeout):
+	}
+	rs.fail(io.EOF)
+	return nil
+}
+
+// Reconnects returns the number of successful reconnects.
+func (rs *ResilientSocket) Reconnects() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.reconnects
+}
+
+// IsClient checks if the socket is initiated as a client or a server.
+func (rs *ResilientSocket) IsClient() bool {
+	return rs.socketType == Client
+}
+
+// LocalAddr returns the QSocket address of the local peer.
+func (rs *ResilientSocket) LocalAddr() net.Addr {
+	return newAddr(rs.socketType, rs.keys)
+}
+
+// RemoteAddr returns the QSocket address of the remote peer.
+func (rs *ResilientSocket) RemoteAddr() net.Addr {
+	if rs.IsClient() {
+		return newAddr(Server, rs.keys)
+	}
+	return newAddr(Client, rs.keys)
+}
+
+// SetDeadline sets the read and write deadlines.
+func (rs *ResilientSocket) SetDeadline(t time.Time) error {
+	rs.mu.Lock()
+	rs.readDeadline = t
+	rs.writeDeadline = t
+	rs.cond.Broadcast()
+	rs.mu.Unlock()
+	return nil
+}
+
+// SetReadDeadline sets the read deadline, deadlines are not affected by reconnects.
+func (rs *ResilientSocket) SetReadDeadline(t time.Time) error {
+	rs.mu.Lock()
+	rs.readDeadline = t
+	rs.cond.Broadcast()
+	rs.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline, deadlines are not affected by reconnects.
+func (rs *ResilientSocket) SetWriteDeadline(t time.Time) error {
+	rs.mu.Lock()
+	rs.writeDeadline = t
+	rs.cond.Broadcast()
+	rs.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+func TestCipherSuites(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	for _, suite := range []string{
+		qsocket.CIPHER_SUITE_AES_256_GCM,
+		qsocket.CIPHER_SUITE_CHACHA20_POLY1305,
+		qsocket.CIPHER_SUITE_XCHACHA20_POLY1305,
+	} {
+		// The server supports every suite, the client picks one.
+		cfg := r.Config()
+		cfg.CipherSuites = []string{suite}
+		client, err := qsocket.NewSocketWithConfig(qsocket.Client, "suite-"+suite, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := qsocket.NewSocketWithConfig(qsocket.Server, "suite-"+suite, r.Config())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := qsockettest.DialSockets(context.Background(), client, server, true); err != nil {
+			t.Fatal(err)
+		}
+		if client.CipherSuite() != suite || server.CipherSuite() != suite {
+			t.Errorf("negotiated %s/%s, want %s", client.CipherSuite(), server.CipherSuite(), suite)
+		}
+
+		msg := bytes.Repeat([]byte(suite), 20000)
+		go server.Write(msg)
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Errorf("%s: client received corrupted data", suite)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestNoCommonCipherSuite(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	cliCfg := r.Config()
+	cliCfg.CipherSuites = []string{qsocket.CIPHER_SUITE_AES_256_GCM}
+	srvCfg := r.Config()
+	srvCfg.CipherSuites = []string{qsocket.CIPHER_SUITE_CHACHA20_POLY1305}
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "suite-none", cliCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := qsocket.NewSocketWithConfig(qsocket.Server, "suite-none", srvCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = qsockettest.DialSockets(context.Background(), client, server, true)
+	if !errors.Is(err, qsocket.ErrNoCommonCipherSuite) {
+		t.Errorf("got %v, want %v", err, qsocket.ErrNoCommonCipherSuite)
+	}
+}
+
+func TestCipherSuitePreference(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	// Servers without AES instructions prefer their own order,
+	// run with GODEBUG=cpu.aes=off for covering them on other CPUs.
+	aesHardware := qsocket.DefaultCipherSuites[0] == qsocket.CIPHER_SUITE_AES_256_GCM
+	aesFirst := []string{qsocket.CIPHER_SUITE_AES_256_GCM, qsocket.CIPHER_SUITE_CHACHA20_POLY1305}
+	chachaFirst := []string{qsocket.CIPHER_SUITE_CHACHA20_POLY1305, qsocket.CIPHER_SUITE_AES_256_GCM}
+	for i, tc := range []struct {
+		client, server []string
+	}{
+		{aesFirst, chachaFirst},
+		{chachaFirst, aesFirst},
+	} {
+		want := tc.client[0]
+		if !aesHardware {
+			want = tc.server[0]
+		}
+		cliCfg := r.Config()
+		cliCfg.CipherSuites = tc.client
+		srvCfg := r.Config()
+		srvCfg.CipherSuites = tc.server
+		client, err := qsocket.NewSocketWithConfig(qsocket.Client, "suite-preference", cliCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := qsocket.NewSocketWithConfig(qsocket.Server, "suite-preference", srvCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := qsockettest.DialSockets(context.Background(), client, server, true); err != nil {
+			t.Fatal(err)
+		}
+		if client.CipherSuite() != want || server.CipherSuite() != want {
+			t.Errorf("case %d: negotiated %s/%s, want %s", i, client.CipherSuite(), server.CipherSuite(), want)
+		}
+		client.Close()
+		server.Close()
+	}
+}
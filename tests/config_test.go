@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qsocket/qsocket-go"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := qsocket.DefaultConfig().Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	var nilConfig *qsocket.Config
+	if err := nilConfig.Validate(); err != qsocket.ErrNilConfig {
+		t.Errorf("got %v, want %v", err, qsocket.ErrNilConfig)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		mutate func(*qsocket.Config)
+		err    error
+	}{
+		{"empty gate", func(c *qsocket.Config) { c.Gate = "" }, qsocket.ErrInvalidGateAddress},
+		{"zero port", func(c *qsocket.Config) { c.Port = 0 }, qsocket.ErrInvalidGatePort},
+		{"large TLS port", func(c *qsocket.Config) { c.TLSPort = 65536 }, qsocket.ErrInvalidGatePort},
+		{"negative dial timeout", func(c *qsocket.Config) { c.DialTimeout = -time.Second }, qsocket.ErrInvalidTimeout},
+		{"negative handshake timeout", func(c *qsocket.Config) { c.HandshakeTimeout = -time.Second }, qsocket.ErrInvalidTimeout},
+		{"negative key exchange timeout", func(c *qsocket.Config) { c.KeyExchangeTimeout = -time.Second }, qsocket.ErrInvalidTimeout},
+		{"negative max conns", func(c *qsocket.Config) { c.MaxConns = -1 }, qsocket.ErrInvalidMaxConns},
+		{"short fingerprint", func(c *qsocket.Config) { c.CertFingerprint = "abcd" }, qsocket.ErrInvalidCertFingerprint},
+		{"unknown UID version", func(c *qsocket.Config) { c.UIDVersion = 3 }, qsocket.ErrInvalidUIDVersion},
+	} {
+		cfg := qsocket.DefaultConfig()
+		tc.mutate(cfg)
+		if err := cfg.Validate(); err != tc.err {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.err)
+		}
+		if _, err := qsocket.NewSocketWithConfig(qsocket.Client, "config", cfg); err != tc.err {
+			t.Errorf("%s: NewSocketWithConfig got %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestConfigClone(t *testing.T) {
+	cfg := qsocket.DefaultConfig()
+	cfg.Reconnect = qsocket.DefaultReconnectConfig()
+	cfg.CipherSuites = []string{qsocket.CIPHER_SUITE_CHACHA20_POLY1305}
+
+	qs, err := qsocket.NewSocketWithConfig(qsocket.Client, "config", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Gate = "changed.example.com"
+	cfg.Reconnect.MaxAttempts = 42
+	cfg.CipherSuites[0] = qsocket.CIPHER_SUITE_AES_256_GCM
+
+	got := qs.Config()
+	if got.Gate != qsocket.QSRN_GATE ||
+		got.Reconnect.MaxAttempts == 42 ||
+		got.CipherSuites[0] != qsocket.CIPHER_SUITE_CHACHA20_POLY1305 {
+		t.Errorf("socket config changed with the given config: %+v", got)
+	}
+}
+
+func TestSetGate(t *testing.T) {
+	qs := qsocket.NewSocket(qsocket.Client, "config")
+	if err := qs.SetGate("", 80, 443); err != qsocket.ErrInvalidGateAddress {
+		t.Errorf("got %v, want %v", err, qsocket.ErrInvalidGateAddress)
+	}
+	if err := qs.SetGate("relay.example.com", 80, 0); err != qsocket.ErrInvalidGatePort {
+		t.Errorf("got %v, want %v", err, qsocket.ErrInvalidGatePort)
+	}
+	if err := qs.SetGate("relay.example.com", 8080, 8443); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := qs.Config(); cfg.Gate != "relay.example.com" || cfg.Port != 8080 || cfg.TLSPort != 8443 {
+		t.Errorf("unexpected gate config %s:%d/%d", cfg.Gate, cfg.Port, cfg.TLSPort)
+	}
+	if _, err := qsocket.NewSocketWithConfig(qsocket.SocketType(7), "config", qsocket.DefaultConfig()); err != qsocket.ErrUnexpectedSocket {
+		t.Errorf("got %v, want %v", err, qsocket.ErrUnexpectedSocket)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+// newHandshakePair pairs an E2E client with a raw server for driving the handshake by hand.
+func newHandshakePair(t *testing.T, r *qsockettest.Relay, secret string) (client, server *qsocket.QSocket, errc chan error) {
+	cfg := r.Config()
+	cfg.KeyExchangeTimeout = 500 * time.Millisecond
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, secret, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := r.Config()
+	raw.E2E = false
+	server, err = qsocket.NewSocketWithConfig(qsocket.Server, secret, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srvErr := make(chan error, 1)
+	go func() { srvErr <- server.Dial(true) }()
+	errc = make(chan error, 1)
+	go func() {
+		for {
+			err := client.Dial(true)
+			if !errors.Is(err, qsocket.ErrPeerNotFound) {
+				errc <- err
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	// The raw server finishes dialing as soon as the peers are paired.
+	if err := <-srvErr; err != nil {
+		t.Fatal(err)
+	}
+	return client, server, errc
+}
+
+func TestKeyExchangeTimeout(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	client, server, errc := newHandshakePair(t, r, "handshake-timeout")
+	defer server.Close()
+	defer client.Close()
+
+	// The server never answers the handshake.
+	err := <-errc
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("got %v, want timeout error", err)
+	}
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	client, server, errc := newHandshakePair(t, r, "handshake-version")
+	defer server.Close()
+	defer client.Close()
+
+	// Answer with a frame of an unknown handshake version, split in two writes.
+	server.Write([]byte{qsocket.HANDSHAKE_VERSION + 1})
+	time.Sleep(10 * time.Millisecond)
+	server.Write([]byte{1, 0, 0})
+	if err := <-errc; !errors.Is(err, qsocket.ErrHandshakeVersion) {
+		t.Errorf("got %v, want %v", err, qsocket.ErrHandshakeVersion)
+	}
+}
+
+// cancelLogger cancels the dial context once the protocol switch is completed.
+type cancelLogger struct {
+	cancel context.CancelFunc
+}
+
+func (l cancelLogger) Printf(format string, v ...any) {
+	if strings.HasPrefix(format, "Protocol switch completed") {
+		l.cancel()
+		// Let the context watcher interrupt the connection first.
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestKeyExchangeCanceled(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	// The raw server never answers the key exchange.
+	raw := r.Config()
+	raw.E2E = false
+	server, err := qsocket.NewSocketWithConfig(qsocket.Server, "handshake-canceled", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	srvErr := make(chan error, 1)
+	go func() { srvErr <- server.Dial(true) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := r.Config()
+	cfg.KeyExchangeTimeout = 5 * time.Second
+	cfg.Logger = cancelLogger{cancel}
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "handshake-canceled", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		start := time.Now()
+		err = client.DialContext(ctx, true)
+		if errors.Is(err, qsocket.ErrPeerNotFound) {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("canceled dial took %v", elapsed)
+		}
+		break
+	}
+	if err := <-srvErr; err != nil {
+		t.Fatal(err)
+	}
+}
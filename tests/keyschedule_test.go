@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+	"golang.org/x/crypto/hkdf"
+)
+
+// fixedKeyExchange is a key exchange without messages that returns a
+// known session key, so the test can follow the E2E key schedule.
+type fixedKeyExchange []byte
+
+func (fixedKeyExchange) Name() string { return "test-fixed-key" }
+
+func (kx fixedKeyExchange) Exchange(io.ReadWriter, qsocket.SocketType, []byte) ([]byte, error) {
+	return append([]byte{}, kx...), nil
+}
+
+var testSessionKey = fixedKeyExchange(bytes.Repeat([]byte{0x42}, 32))
+
+// fixedKeyHello returns the hello frame of both peers using the fixed key
+// exchange and AES-256-GCM, and the resulting handshake transcript hash.
+func fixedKeyHello() (frame, transcriptHash []byte) {
+	payload := helloPayload([]string{testSessionKey.Name()}, []string{qsocket.CIPHER_SUITE_AES_256_GCM})
+	frame = append([]byte{qsocket.HANDSHAKE_VERSION, 1, 0, byte(len(payload))}, payload...)
+	h := sha256.Sum256(frame)
+	sum := sha256.Sum256(append(h[:], h[:]...))
+	return frame, sum[:]
+}
+
+// dialFixedKeyPair pairs an E2E socket using the fixed key exchange with a
+// raw peer socket, the handshake of the raw peer is performed by the test.
+func dialFixedKeyPair(t *testing.T, r *qsockettest.Relay, secret string, e2eType qsocket.SocketType) (e2e, raw *qsocket.QSocket) {
+	cfg := r.Config()
+	cfg.CipherSuites = []string{qsocket.CIPHER_SUITE_AES_256_GCM}
+	e2e, err := qsocket.NewSocketWithConfig(e2eType, secret, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e2e.SetKeyExchanges(testSessionKey); err != nil {
+		t.Fatal(err)
+	}
+	cfg.E2E = false
+	rawType := qsocket.Server
+	if e2eType == qsocket.Server {
+		rawType = qsocket.Client
+	}
+	raw, err = qsocket.NewSocketWithConfig(rawType, secret, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := e2e, raw
+	if e2eType == qsocket.Server {
+		client, server = raw, e2e
+	}
+	srvErr := make(chan error, 1)
+	go func() { srvErr <- server.Dial(false) }()
+	cliErr := make(chan error, 1)
+	go func() { cliErr <- dialUntilPaired(client) }()
+	rawErr, e2eErr := srvErr, cliErr
+	if e2eType == qsocket.Server {
+		rawErr, e2eErr = cliErr, srvErr
+	}
+	if err := <-rawErr; err != nil {
+		t.Fatal(err)
+	}
+
+	hello, _ := fixedKeyHello()
+	if _, err := raw.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	peerHello := make([]byte, len(hello))
+	if _, err := io.ReadFull(raw, peerHello); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(peerHello, hello) {
+		t.Fatalf("unexpected hello frame %q", peerHello)
+	}
+	if err := <-e2eErr; err != nil {
+		t.Fatal(err)
+	}
+	return e2e, raw
+}
+
+// readChunk reads a single encrypted stream chunk with its length prefix.
+func readChunk(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, 4+binary.LittleEndian.Uint32(hdr[:]))
+	copy(chunk, hdr[:])
+	_, err := io.ReadFull(r, chunk[4:])
+	return chunk, err
+}
+
+// openChunk opens an AES-256-GCM chunk of the first key epoch with the traffic
+// key of the given direction label, following the E2E key schedule.
+func openChunk(t *testing.T, label string, chunk []byte) ([]byte, error) {
+	expand := func(secret []byte, label string, size int) []byte {
+		out := make([]byte, size)
+		if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, []byte(label)), out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	_, transcriptHash := fixedKeyHello()
+	secret := expand(hkdf.Extract(sha256.New, testSessionKey, transcriptHash), label, 32)
+	block, err := aes.NewCipher(expand(secret, "qsocket e2e v1 key", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := expand(secret, "qsocket e2e v1 nonce", aead.NonceSize())
+	body := chunk[4:]
+	for i := range nonce {
+		nonce[i] ^= body[i]
+	}
+	body = body[aead.NonceSize():]
+	return aead.Open(nil, nonce, body[1:], body[:1])
+}
+
+func TestE2EDirectionalKeys(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	msg := []byte("directional keys")
+	for _, tc := range []struct {
+		sender       qsocket.SocketType
+		label, other string
+	}{
+		{qsocket.Client, "qsocket e2e v1 c2s", "qsocket e2e v1 s2c"},
+		{qsocket.Server, "qsocket e2e v1 s2c", "qsocket e2e v1 c2s"},
+	} {
+		e2e, raw := dialFixedKeyPair(t, r, "e2e-directional", tc.sender)
+		go e2e.Write(msg)
+		chunk, err := readChunk(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e2e.Close()
+		raw.Close()
+
+		plaintext, err := openChunk(t, tc.label, chunk)
+		if err != nil || !bytes.Equal(plaintext, msg) {
+			t.Errorf("%s: chunk does not open with its direction key: %v", tc.label, err)
+		}
+		if _, err := openChunk(t, tc.other, chunk); err == nil {
+			t.Errorf("%s: chunk opens with the %s key", tc.label, tc.other)
+		}
+	}
+}
+
+func TestE2EReplayAndReorder(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	// Record two chunks of a client, the keys are the same for every
+	// session since the session key and the transcript are fixed.
+	client, raw := dialFixedKeyPair(t, r, "e2e-record", qsocket.Client)
+	go func() {
+		client.Write([]byte("first"))
+		client.Write([]byte("second"))
+	}()
+	var chunks [][]byte
+	for i := 0; i < 2; i++ {
+		chunk, err := readChunk(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	client.Close()
+	raw.Close()
+
+	for _, tc := range []struct {
+		name  string
+		order []int
+		valid int
+	}{
+		{"in order", []int{0, 1}, 2},
+		{"replayed", []int{0, 0}, 1},
+		{"reordered", []int{1, 0}, 0},
+	} {
+		server, raw := dialFixedKeyPair(t, r, "e2e-replay", qsocket.Server)
+		for _, i := range tc.order {
+			raw.Write(chunks[i])
+		}
+		buf := make([]byte, 64)
+		for i := range tc.order {
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err := server.Read(buf)
+			if i < tc.valid && err != nil {
+				t.Errorf("%s: chunk %d rejected: %v", tc.name, i, err)
+			}
+			if i >= tc.valid {
+				if err == nil {
+					t.Errorf("%s: chunk %d accepted", tc.name, i)
+				}
+				break
+			}
+		}
+		server.Close()
+		raw.Close()
+	}
+}
+
+// helloPayload encodes the name lists of a handshake hello frame.
+func helloPayload(lists ...[]string) []byte {
+	var payload []byte
+	for _, names := range lists {
+		payload = append(payload, byte(len(names)))
+		for _, name := range names {
+			payload = append(payload, byte(len(name)))
+			payload = append(payload, name...)
+		}
+	}
+	return payload
+}
+
+// dialUntilPaired dials the client socket until the server registers on the relay.
+func dialUntilPaired(client *qsocket.QSocket) error {
+	for {
+		err := client.Dial(false)
+		if !errors.Is(err, qsocket.ErrPeerNotFound) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestE2ETranscriptBinding(t *testing.T) {
+	// The peers are on separate relays and the test relays the handshake
+	// between two raw sockets, so it can tamper with the client hello.
+	r1 := qsockettest.NewRelay()
+	defer r1.Close()
+	r2 := qsockettest.NewRelay()
+	defer r2.Close()
+
+	kxs := []string{qsocket.KEY_EXCHANGE_CPACE}
+	suites := []string{qsocket.CIPHER_SUITE_AES_256_GCM, qsocket.CIPHER_SUITE_CHACHA20_POLY1305}
+	offer := helloPayload(kxs, suites)
+	tampered := helloPayload(kxs, []string{suites[1], suites[0]})
+
+	for _, tamper := range []bool{false, true} {
+		cfg1, cfg2 := r1.Config(), r2.Config()
+		for _, cfg := range []*qsocket.Config{cfg1, cfg2} {
+			cfg.KeyExchanges = kxs
+			cfg.CipherSuites = suites
+		}
+		client, err := qsocket.NewSocketWithConfig(qsocket.Client, "e2e-transcript", cfg1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := qsocket.NewSocketWithConfig(qsocket.Server, "e2e-transcript", cfg2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg1.E2E, cfg2.E2E = false, false
+		rawServer, err := qsocket.NewSocketWithConfig(qsocket.Server, "e2e-transcript", cfg1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawClient, err := qsocket.NewSocketWithConfig(qsocket.Client, "e2e-transcript", cfg2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		srvErr := make(chan error, 1)
+		go func() { srvErr <- server.Dial(false) }()
+		if err := dialUntilPaired(rawClient); err != nil {
+			t.Fatal(err)
+		}
+		rawErr := make(chan error, 1)
+		go func() { rawErr <- rawServer.Dial(false) }()
+		cliErr := make(chan error, 1)
+		go func() { cliErr <- dialUntilPaired(client) }()
+		if err := <-rawErr; err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			hdr := make([]byte, 4)
+			if _, err := io.ReadFull(rawServer, hdr); err != nil {
+				return
+			}
+			hello := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+			if _, err := io.ReadFull(rawServer, hello); err != nil {
+				return
+			}
+			if !bytes.Equal(hello, offer) {
+				t.Errorf("unexpected client hello %q", hello)
+			}
+			if tamper {
+				hello = tampered
+			}
+			rawClient.Write(append(hdr, hello...))
+			io.Copy(rawClient, rawServer)
+		}()
+		go io.Copy(rawServer, rawClient)
+
+		if err := <-cliErr; err != nil {
+			t.Fatal(err)
+		}
+		if err := <-srvErr; err != nil {
+			t.Fatal(err)
+		}
+
+		// The key exchange itself succeeds, the keys are bound to the transcript.
+		msg := []byte("transcript")
+		go client.Write(msg)
+		buf := make([]byte, len(msg))
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(server, buf)
+		if tamper && err == nil {
+			t.Error("first read succeeded with a tampered handshake transcript")
+		}
+		if !tamper && (err != nil || !bytes.Equal(buf, msg)) {
+			t.Errorf("read %q, %v, want %q", buf, err, msg)
+		}
+
+		client.Close()
+		server.Close()
+		rawClient.Close()
+		rawServer.Close()
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/qsocket/qsocket-go"
+)
+
+// TestKnockSplitResponse checks that a protocol switch response split
+// across segments is parsed and the trailing peer bytes are preserved.
+func TestKnockSplitResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"X-Relay-Region: test\r\n" +
+			"Sec-WebSocket-Accept: " + qsocket.WebsocketAcceptKey(req.Header.Get("Sec-WebSocket-Key")) + "\r\n" +
+			"\r\n" +
+			"peer data"
+		for len(resp) > 0 {
+			n := 7
+			if n > len(resp) {
+				n = len(resp)
+			}
+			conn.Write([]byte(resp[:n]))
+			resp = resp[n:]
+			time.Sleep(time.Millisecond)
+		}
+		io.Copy(io.Discard, conn)
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	cfg := qsocket.DefaultConfig()
+	cfg.Gate = "127.0.0.1"
+	cfg.Port = p
+	cfg.TLS = false
+	cfg.E2E = false
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "knock-split", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Dial(false); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	resp := client.RelayResponse()
+	if resp == nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected relay response %v", resp)
+	}
+	if resp.Header.Get("X-Relay-Region") != "test" {
+		t.Errorf("missing relay header, got %v", resp.Header)
+	}
+
+	buf := make([]byte, len("peer data"))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "peer data" {
+		t.Errorf("read %q, want %q", buf, "peer data")
+	}
+}
+
+// knockKey returns the `Sec-WebSocket-Key` sent by a socket with the given UID version.
+func knockKey(t *testing.T, secret string, version int) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	keys := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		keys <- req.Header.Get("Sec-WebSocket-Key")
+		conn.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"))
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	cfg := qsocket.DefaultConfig()
+	cfg.Gate = "127.0.0.1"
+	cfg.Port = p
+	cfg.UIDVersion = version
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, secret, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Dial(false); !errors.Is(err, qsocket.ErrPeerNotFound) {
+		t.Fatalf("got %v, want %v", err, qsocket.ErrPeerNotFound)
+	}
+	return <-keys
+}
+
+func TestUIDDerivation(t *testing.T) {
+	legacy := md5.Sum([]byte("uid-secret"))
+	if key := knockKey(t, "uid-secret", qsocket.UID_V1); key != base64.StdEncoding.EncodeToString(legacy[:]) {
+		t.Errorf("legacy UID %q is not the MD5 of the secret", key)
+	}
+
+	key := knockKey(t, "uid-secret", 0)
+	uid, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(uid) != 16 {
+		t.Fatalf("invalid UID %q", key)
+	}
+	if bytes.Equal(uid, legacy[:]) {
+		t.Error("default UID must not be the MD5 of the secret")
+	}
+	if key != knockKey(t, "uid-secret", qsocket.UID_V2) {
+		t.Error("UID derivation is not deterministic")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+func TestListenerServesHTTP(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	cfg := r.Config()
+	l, err := qsocket.Listen("listener-http", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "hello %s", req.URL.Path)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			qs, err := qsocket.NewSocketWithConfig(qsocket.Client, "listener-http", cfg)
+			if err != nil {
+				return nil, err
+			}
+			for {
+				err = qs.DialContext(ctx, true)
+				if err == nil {
+					return qs, nil
+				}
+				if !errors.Is(err, qsocket.ErrPeerNotFound) {
+					return nil, err
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		},
+	}}
+
+	// Each request uses a new QSocket pairing.
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(fmt.Sprintf("http://qsocket/%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("hello /%d", i); string(body) != want {
+			t.Errorf("got %q, want %q", body, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/qsocket/qsocket-go/mux"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+func TestMultiplexStreams(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	client, server, err := r.DialPair(context.Background(), "mux-streams", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliSession, err := client.Multiplex(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cliSession.Close()
+	srvSession, err := server.Multiplex(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvSession.Close()
+
+	// Both sides echo the streams opened by the other side.
+	echo := func(s *mux.Session) {
+		for {
+			st, err := s.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}
+	go echo(cliSession)
+	go echo(srvSession)
+
+	// Larger than the stream window for exercising the flow control.
+	payload := make([]byte, 1<<20)
+	rand.Read(payload)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 4; i++ {
+		for _, s := range []*mux.Session{cliSession, srvSession} {
+			wg.Add(1)
+			go func(s *mux.Session) {
+				defer wg.Done()
+				st, err := s.OpenStream()
+				if err != nil {
+					errs <- err
+					return
+				}
+				go func() {
+					st.Write(payload)
+					st.Close()
+				}()
+				got, err := io.ReadAll(st)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(got, payload) {
+					errs <- fmt.Errorf("stream %d: echoed data mismatch", st.ID())
+				}
+			}(s)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestMuxConfigValidate(t *testing.T) {
+	if err := mux.DefaultConfig().Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		mutate func(*mux.Config)
+		err    error
+	}{
+		{"zero backlog", func(c *mux.Config) { c.AcceptBacklog = 0 }, mux.ErrInvalidAcceptBacklog},
+		{"small window", func(c *mux.Config) { c.MaxStreamWindow = 1024 }, mux.ErrInvalidStreamWindow},
+		{"negative keepalive", func(c *mux.Config) { c.KeepAliveInterval = -1 }, mux.ErrInvalidKeepAliveInterval},
+	} {
+		cfg := mux.DefaultConfig()
+		tc.mutate(cfg)
+		if err := cfg.Validate(); err != tc.err {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
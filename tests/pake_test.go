@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+func TestKeyExchangeNegotiation(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	for _, tc := range []struct {
+		client, server []string
+		want           string
+	}{
+		{nil, nil, qsocket.KEY_EXCHANGE_CPACE},
+		{[]string{qsocket.KEY_EXCHANGE_SRP}, nil, qsocket.KEY_EXCHANGE_SRP},
+		{nil, []string{qsocket.KEY_EXCHANGE_SRP}, qsocket.KEY_EXCHANGE_SRP},
+	} {
+		cliCfg := r.Config()
+		cliCfg.KeyExchanges = tc.client
+		srvCfg := r.Config()
+		srvCfg.KeyExchanges = tc.server
+		client, err := qsocket.NewSocketWithConfig(qsocket.Client, "kx-"+tc.want, cliCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := qsocket.NewSocketWithConfig(qsocket.Server, "kx-"+tc.want, srvCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := qsockettest.DialSockets(context.Background(), client, server, true); err != nil {
+			t.Fatal(err)
+		}
+		if client.KeyExchangeName() != tc.want || server.KeyExchangeName() != tc.want {
+			t.Errorf("negotiated %s/%s, want %s", client.KeyExchangeName(), server.KeyExchangeName(), tc.want)
+		}
+
+		msg := []byte("hello over " + tc.want)
+		go client.Write(msg)
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(server, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != string(msg) {
+			t.Errorf("server read %q, want %q", buf, msg)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestNoCommonKeyExchange(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	cliCfg := r.Config()
+	cliCfg.KeyExchanges = []string{qsocket.KEY_EXCHANGE_CPACE}
+	srvCfg := r.Config()
+	srvCfg.KeyExchanges = []string{qsocket.KEY_EXCHANGE_SRP}
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "kx-none", cliCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := qsocket.NewSocketWithConfig(qsocket.Server, "kx-none", srvCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = qsockettest.DialSockets(context.Background(), client, server, true)
+	if !errors.Is(err, qsocket.ErrNoCommonKeyExchange) {
+		t.Errorf("got %v, want %v", err, qsocket.ErrNoCommonKeyExchange)
+	}
+}
+
+// renamedKeyExchange is a custom key exchange wrapping a built-in one.
+type renamedKeyExchange struct {
+	qsocket.KeyExchange
+	name string
+}
+
+func (kx renamedKeyExchange) Name() string { return kx.name }
+
+func TestSetKeyExchanges(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	cpace, err := qsocket.NewKeyExchange(qsocket.KEY_EXCHANGE_CPACE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom := renamedKeyExchange{cpace, "custom-cpace"}
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "kx-custom", r.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := qsocket.NewSocketWithConfig(qsocket.Server, "kx-custom", r.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, qs := range []*qsocket.QSocket{client, server} {
+		if err := qs.SetKeyExchanges(custom); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, true); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	if client.KeyExchangeName() != custom.name || server.KeyExchangeName() != custom.name {
+		t.Errorf("negotiated %s/%s, want %s", client.KeyExchangeName(), server.KeyExchangeName(), custom.name)
+	}
+	if err := client.SetKeyExchanges(cpace); err != qsocket.ErrSocketInUse {
+		t.Errorf("got %v, want %v", err, qsocket.ErrSocketInUse)
+	}
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+// socksRequest is a CONNECT request received by the test SOCKS5 proxy.
+type socksRequest struct {
+	addr       string
+	user, pass string
+}
+
+// socksProxy is a minimal SOCKS5 proxy that forwards every
+// CONNECT request to a fixed target and records the requests.
+type socksProxy struct {
+	net.Listener
+	target string
+
+	mu       sync.Mutex
+	requests []socksRequest
+}
+
+func newSocksProxy(t *testing.T, network, addr, target string) *socksProxy {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &socksProxy{Listener: l, target: target}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return p
+}
+
+func (p *socksProxy) Requests() []socksRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]socksRequest{}, p.requests...)
+}
+
+func (p *socksProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	req, err := p.handshake(conn)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.requests = append(p.requests, req)
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func (p *socksProxy) handshake(conn net.Conn) (req socksRequest, err error) {
+	readBytes := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(conn, b)
+		return b, err
+	}
+	readString := func() (string, error) {
+		n, err := readBytes(1)
+		if err != nil {
+			return "", err
+		}
+		b, err := readBytes(int(n[0]))
+		return string(b), err
+	}
+
+	hdr, err := readBytes(2)
+	if err != nil {
+		return req, err
+	}
+	methods, err := readBytes(int(hdr[1]))
+	if err != nil {
+		return req, err
+	}
+	method := byte(0)
+	for _, m := range methods {
+		if m == 2 {
+			method = 2
+		}
+	}
+	conn.Write([]byte{5, method})
+	if method == 2 {
+		if _, err := readBytes(1); err != nil {
+			return req, err
+		}
+		if req.user, err = readString(); err != nil {
+			return req, err
+		}
+		if req.pass, err = readString(); err != nil {
+			return req, err
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	hdr, err = readBytes(4)
+	if err != nil {
+		return req, err
+	}
+	var host string
+	switch hdr[3] {
+	case 1:
+		b, err := readBytes(4)
+		if err != nil {
+			return req, err
+		}
+		host = net.IP(b).String()
+	case 3:
+		if host, err = readString(); err != nil {
+			return req, err
+		}
+	case 4:
+		b, err := readBytes(16)
+		if err != nil {
+			return req, err
+		}
+		host = net.IP(b).String()
+	}
+	port, err := readBytes(2)
+	if err != nil {
+		return req, err
+	}
+	req.addr = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return req, nil
+}
+
+const testOnionGate = "qsockettestgate.onion"
+
+func TestTorIsolation(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+	tor := newSocksProxy(t, "tcp", "127.0.0.1:0", r.TLSAddr)
+
+	cfg := r.Config()
+	cfg.TorGate = testOnionGate
+	cfg.Tor = &qsocket.TorConfig{SocksAddr: tor.Addr().String(), IsolateSocket: true}
+	client, server, err := r.NewPairWithConfig("tor-isolation", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, true); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	users := map[string]bool{}
+	for _, req := range tor.Requests() {
+		if want := net.JoinHostPort(testOnionGate, strconv.Itoa(cfg.TLSPort)); req.addr != want {
+			t.Errorf("got CONNECT %s, want %s", req.addr, want)
+		}
+		if req.user == "" {
+			t.Error("missing isolation credentials")
+		}
+		users[req.user] = true
+	}
+	if len(users) != 2 {
+		t.Errorf("got %d isolation credentials, want one for each socket", len(users))
+	}
+}
+
+func TestTorUnixSocket(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+	path := filepath.Join(t.TempDir(), "tor.sock")
+	tor := newSocksProxy(t, "unix", path, r.Addr)
+
+	cfg := r.Config()
+	cfg.TorGate = testOnionGate
+	cfg.Tor = &qsocket.TorConfig{SocksAddr: "unix:" + path, Isolation: "shared"}
+	client, server, err := r.NewPairWithConfig("tor-unix", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, false); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	for _, req := range tor.Requests() {
+		if req.user != "shared" || req.pass != "shared" {
+			t.Errorf("got credentials %q:%q, want shared:shared", req.user, req.pass)
+		}
+	}
+}
+
+func TestInvalidTorConfig(t *testing.T) {
+	for _, addr := range []string{"unix:", "127.0.0.1"} {
+		cfg := qsocket.DefaultConfig()
+		cfg.Tor = &qsocket.TorConfig{SocksAddr: addr}
+		if err := cfg.Validate(); err != qsocket.ErrInvalidTorConfig {
+			t.Errorf("%q: got %v, want %v", addr, err, qsocket.ErrInvalidTorConfig)
+		}
+	}
+}
+
+// connectProxy is a minimal HTTP CONNECT proxy that forwards every
+// tunnel to a fixed target and records the requests.
+type connectProxy struct {
+	net.Listener
+	target string
+	// status is the response status code, 200 if zero.
+	status int
+	// challenge requires answering a connection bound authentication
+	// challenge, like NTLM, with the `Test` scheme.
+	challenge bool
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newConnectProxy(t *testing.T, target string) *connectProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &connectProxy{Listener: l, target: target}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return p
+}
+
+func (p *connectProxy) Requests() []*http.Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*http.Request{}, p.requests...)
+}
+
+func (p *connectProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	challenge := "Test " + conn.RemoteAddr().String()
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		p.mu.Lock()
+		p.requests = append(p.requests, req)
+		p.mu.Unlock()
+
+		if p.status != 0 && p.status != http.StatusOK {
+			conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(p.status) + " " + http.StatusText(p.status) + "\r\nContent-Length: 0\r\n\r\n"))
+			return
+		}
+		if !p.challenge || req.Header.Get("Proxy-Authorization") == challenge {
+			break
+		}
+		body := "authentication required"
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+			"Proxy-Authenticate: " + challenge + "\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+	}
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go io.Copy(upstream, br)
+	io.Copy(conn, upstream)
+}
+
+func TestHTTPConnectProxy(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+	p := newConnectProxy(t, r.TLSAddr)
+
+	cfg := r.Config()
+	cfg.Proxy = "http://user:pass@" + p.Addr().String()
+	cfg.ProxyHeader = http.Header{"X-Tenant": {"qsocket"}}
+	client, server, err := r.NewPairWithConfig("http-proxy", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, true); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	wantAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	reqs := p.Requests()
+	if len(reqs) < 2 {
+		t.Fatalf("got %d CONNECT requests, want at least 2", len(reqs))
+	}
+	for _, req := range reqs {
+		if want := net.JoinHostPort(cfg.Gate, strconv.Itoa(cfg.TLSPort)); req.Host != want {
+			t.Errorf("got CONNECT %s, want %s", req.Host, want)
+		}
+		if got := req.Header.Get("Proxy-Authorization"); got != wantAuth {
+			t.Errorf("got Proxy-Authorization %q, want %q", got, wantAuth)
+		}
+		if got := req.Header.Get("X-Tenant"); got != "qsocket" {
+			t.Errorf("got X-Tenant %q, want qsocket", got)
+		}
+	}
+}
+
+func TestHTTPConnectProxyRefused(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+	p := newConnectProxy(t, r.Addr)
+	p.status = http.StatusProxyAuthRequired
+
+	cfg := r.Config()
+	cfg.Proxy = "http://" + p.Addr().String()
+	client, _, err := r.NewPairWithConfig("http-proxy-refused", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Dial(false); !errors.Is(err, qsocket.ErrProxyConnectFailed) {
+		t.Errorf("got %v, want %v", err, qsocket.ErrProxyConnectFailed)
+	}
+}
+
+func TestHTTPProxyAuthenticator(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+	p := newConnectProxy(t, r.Addr)
+	p.challenge = true
+
+	cfg := r.Config()
+	cfg.Proxy = "http://" + p.Addr().String()
+	client, _, err := r.NewPairWithConfig("http-proxy-challenge", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Dial(false); !errors.Is(err, qsocket.ErrProxyConnectFailed) {
+		t.Errorf("got %v, want %v", err, qsocket.ErrProxyConnectFailed)
+	}
+
+	errDenied := errors.New("denied")
+	cfg.ProxyAuthenticator = func(*http.Response) (string, error) { return "", errDenied }
+	client, _, err = r.NewPairWithConfig("http-proxy-challenge", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Dial(false); !errors.Is(err, errDenied) {
+		t.Errorf("got %v, want %v", err, errDenied)
+	}
+
+	// The answer is only accepted over the connection of the challenge.
+	var mu sync.Mutex
+	challenges := 0
+	cfg.ProxyAuthenticator = func(resp *http.Response) (string, error) {
+		mu.Lock()
+		challenges++
+		mu.Unlock()
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+		}
+		return resp.Header.Get("Proxy-Authenticate"), nil
+	}
+	client, server, err := r.NewPairWithConfig("http-proxy-challenge", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, false); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	server.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if challenges == 0 {
+		t.Error("proxy authenticator is not called")
+	}
+}
+
+func TestSocksProxyAuth(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+	p := newSocksProxy(t, "tcp", "127.0.0.1:0", r.Addr)
+
+	cfg := r.Config()
+	cfg.Proxy = "socks5h://user:pass@" + p.Addr().String()
+	cfg.Gate = qsockettest.ServerName
+	client, server, err := r.NewPairWithConfig("socks-auth", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, false); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	for _, req := range p.Requests() {
+		if req.user != "user" || req.pass != "pass" {
+			t.Errorf("got credentials %q:%q, want user:pass", req.user, req.pass)
+		}
+		// socks5h leaves resolving the gate to the proxy.
+		if want := net.JoinHostPort(qsockettest.ServerName, strconv.Itoa(cfg.Port)); req.addr != want {
+			t.Errorf("got CONNECT %s, want %s", req.addr, want)
+		}
+	}
+}
+
+func TestEnvironmentProxy(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+	p := newConnectProxy(t, r.Addr)
+	t.Setenv("HTTPS_PROXY", p.Addr().String())
+	t.Setenv("NO_PROXY", "excluded.qsocket.test")
+
+	// The environment is ignored by default.
+	cfg := r.Config()
+	client, server, err := r.NewPairWithConfig("env-proxy-off", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, false); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	server.Close()
+	if len(p.Requests()) != 0 {
+		t.Fatal("environment proxy is used without ProxyFromEnvironment")
+	}
+
+	// The gate name is only known to the proxy.
+	cfg.ProxyFromEnvironment = true
+	cfg.Gate = qsockettest.ServerName
+	client, server, err = r.NewPairWithConfig("env-proxy", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, false); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	server.Close()
+	if len(p.Requests()) == 0 {
+		t.Fatal("environment proxy is not used")
+	}
+
+	cfg.Gate = "excluded.qsocket.test"
+	excluded, err := qsocket.NewSocketWithConfig(qsocket.Client, "env-proxy", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(p.Requests())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := excluded.DialContext(ctx, false); err == nil {
+		t.Fatal("dial of the excluded gate succeeded")
+	}
+	if len(p.Requests()) != n {
+		t.Error("NO_PROXY gate is dialed over the proxy")
+	}
+}
+
+// recordingDialer dials the relay directly and records the dialed addresses.
+type recordingDialer struct {
+	target string
+	mu     sync.Mutex
+	addrs  []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.mu.Unlock()
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, d.target)
+}
+
+func TestProxyDialer(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	cfg := r.Config()
+	cfg.Gate = qsockettest.ServerName
+	client, server, err := r.NewPairWithConfig("proxy-dialer", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &recordingDialer{target: r.TLSAddr}
+	for _, qs := range []*qsocket.QSocket{client, server} {
+		if err := qs.SetProxyDialer(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, true); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.addrs) < 2 || d.addrs[0] != net.JoinHostPort(qsockettest.ServerName, strconv.Itoa(cfg.TLSPort)) {
+		t.Errorf("unexpected dialed addresses %v", d.addrs)
+	}
+}
+
+func TestProxyChain(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+	socks := newSocksProxy(t, "tcp", "127.0.0.1:0", r.Addr)
+	connect := newConnectProxy(t, socks.Addr().String())
+
+	cfg := r.Config()
+	cfg.Gate = qsockettest.ServerName
+	cfg.ProxyChain = []qsocket.ProxyHop{
+		{URL: "http://" + connect.Addr().String(), Timeout: 5 * time.Second},
+		{URL: "socks5h://" + socks.Addr().String(), Timeout: 5 * time.Second},
+	}
+	client, server, err := r.NewPairWithConfig("proxy-chain", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, false); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	for _, req := range connect.Requests() {
+		if req.Host != socks.Addr().String() {
+			t.Errorf("first hop got CONNECT %s, want %s", req.Host, socks.Addr())
+		}
+	}
+	for _, req := range socks.Requests() {
+		if want := net.JoinHostPort(qsockettest.ServerName, strconv.Itoa(cfg.Port)); req.addr != want {
+			t.Errorf("second hop got CONNECT %s, want %s", req.addr, want)
+		}
+	}
+	if len(connect.Requests()) == 0 || len(socks.Requests()) == 0 {
+		t.Error("proxy chain is not used")
+	}
+}
+
+func TestProxyChainErrors(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	// The second hop accepts connections but never answers.
+	blackhole, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := blackhole.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+	connect := newConnectProxy(t, blackhole.Addr().String())
+
+	cfg := r.Config()
+	cfg.ProxyChain = []qsocket.ProxyHop{
+		{URL: "http://user:secret@" + connect.Addr().String()},
+		{URL: "socks5h://" + blackhole.Addr().String(), Timeout: 200 * time.Millisecond},
+	}
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "proxy-chain-errors", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Dial(false)
+	var pe *qsocket.ProxyError
+	if !errors.As(err, &pe) || pe.Hop != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a timeout of hop 1", err)
+	}
+
+	// The first hop refuses the tunnel.
+	connect.status = http.StatusForbidden
+	err = client.Dial(false)
+	if !errors.As(err, &pe) || pe.Hop != 0 || !errors.Is(err, qsocket.ErrProxyConnectFailed) {
+		t.Fatalf("got %v, want a CONNECT failure of hop 0", err)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("proxy password is leaked in %q", err)
+	}
+}
+
+func TestInvalidProxyConfig(t *testing.T) {
+	for _, tc := range []struct {
+		mutate func(*qsocket.Config)
+		err    error
+	}{
+		{func(c *qsocket.Config) { c.Proxy = "ftp://proxy:21" }, qsocket.ErrUnsupportedProxy},
+		{func(c *qsocket.Config) { c.Proxy = "http://" }, qsocket.ErrInvalidProxyURL},
+		{func(c *qsocket.Config) {
+			c.Proxy = "127.0.0.1:1080"
+			c.ProxyChain = []qsocket.ProxyHop{{URL: "127.0.0.1:1081"}}
+		}, qsocket.ErrProxyConflict},
+		{func(c *qsocket.Config) {
+			c.ProxyChain = []qsocket.ProxyHop{{URL: "127.0.0.1:1081", Timeout: -1}}
+		}, qsocket.ErrInvalidProxyHop},
+	} {
+		cfg := qsocket.DefaultConfig()
+		tc.mutate(cfg)
+		if err := cfg.Validate(); err != tc.err {
+			t.Errorf("got %v, want %v", err, tc.err)
+		}
+	}
+}
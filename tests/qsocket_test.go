@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+func TestE2EOverTLS(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	client, server, err := r.DialPair(context.Background(), "e2e-over-tls", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	if !client.IsE2E() || !server.IsE2E() {
+		t.Fatal("expected E2E encrypted sockets")
+	}
+
+	msg := bytes.Repeat([]byte("qsocket"), 10000)
+	go client.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Error("server received corrupted data")
+	}
+}
+
+func TestCertFingerprintMismatch(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	cfg := r.Config()
+	cfg.CertFingerprint = "0000000000000000000000000000000000000000000000000000000000000000"
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "cert-mismatch", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Dial(true); !errors.Is(err, qsocket.ErrUntrustedCert) {
+		t.Errorf("got %v, want %v", err, qsocket.ErrUntrustedCert)
+	}
+}
+
+func TestDialContextTimeout(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	// Nobody pairs with the server, so the dial must end with the context.
+	_, server, err := r.NewPair("dial-timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := server.DialContext(ctx, true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !server.IsClosed() {
+		t.Error("socket should be closed after a canceled dial")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	// Dial errors are kept while the handshake timeout is running.
+	cfg := r.Config()
+	cfg.HandshakeTimeout = 5 * time.Second
+	client, server, err := r.NewPairWithConfig("handshake-timeout", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Dial(true); !errors.Is(err, qsocket.ErrPeerNotFound) {
+		t.Errorf("got %v, want %v", err, qsocket.ErrPeerNotFound)
+	}
+
+	// Nobody pairs with the server, so the dial must end with the timeout.
+	server.Close()
+	cfg.HandshakeTimeout = 200 * time.Millisecond
+	_, server, err = r.NewPairWithConfig("handshake-timeout", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Dial(true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !server.IsClosed() {
+		t.Error("socket should be closed after a timed out dial")
+	}
+}
+
+func TestNetConn(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	cfg := r.Config()
+	cfg.E2E = false
+	client, server, err := r.NewPairWithConfig("net-conn", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if client.RemoteAddr().String() != server.LocalAddr().String() {
+		t.Errorf("client remote %s != server local %s", client.RemoteAddr(), server.LocalAddr())
+	}
+	if client.LocalAddr().Network() != "qsocket" {
+		t.Errorf("unexpected network %q", client.LocalAddr().Network())
+	}
+
+	server.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = server.Read(make([]byte, 1))
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("got %v, want timeout error", err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Errorf("close: %s", err)
+	}
+	if err := server.Close(); err != nil {
+		t.Errorf("close: %s", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+// The tests below stress the concurrency model of QSocket,
+// they are meant to be run with `go test -race`.
+
+// TestConcurrentReadWriteClose runs a reader and a writer on both peers
+// and closes the sockets while the data is still flowing.
+func TestConcurrentReadWriteClose(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	for i := 0; i < 3; i++ {
+		client, server, err := r.DialPair(context.Background(), "race-rw", i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for _, qs := range []*qsocket.QSocket{client, server} {
+			qs := qs
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				buf := bytes.Repeat([]byte{'x'}, 4096)
+				for {
+					if _, err := qs.Write(buf); err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, 4096)
+				for {
+					if _, err := qs.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		var closers sync.WaitGroup
+		for _, qs := range []*qsocket.QSocket{client, server, client, server} {
+			qs := qs
+			closers.Add(1)
+			go func() {
+				defer closers.Done()
+				qs.Close()
+			}()
+		}
+		closers.Wait()
+		waitTimeout(t, &wg, 5*time.Second)
+
+		if !client.IsClosed() || !server.IsClosed() {
+			t.Fatal("sockets should be closed")
+		}
+	}
+}
+
+// TestCloseDuringDial closes the sockets at different stages of the dial sequence.
+func TestCloseDuringDial(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	for _, delay := range []time.Duration{0, time.Millisecond, 5 * time.Millisecond, 20 * time.Millisecond} {
+		client, server, err := r.NewPair("race-dial")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The client redials while the server is not registered, so the dial is bounded.
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		done := make(chan error, 1)
+		go func() { done <- qsockettest.DialSockets(ctx, client, server, true) }()
+
+		time.Sleep(delay)
+		client.Close()
+		server.Close()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("dial did not return after close (delay %s)", delay)
+		}
+		cancel()
+		client.Close()
+		server.Close()
+		if !client.IsClosed() || !server.IsClosed() {
+			t.Fatal("sockets should be closed")
+		}
+	}
+}
+
+// TestSocketChanClose closes a socket while CreateSocketChan is polling it.
+func TestSocketChanClose(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	client, server, err := r.DialPair(context.Background(), "race-chan", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	c := qsocket.CreateSocketChan(server)
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if b := <-c; string(b) != "ping" {
+		t.Fatalf("got %q, want %q", b, "ping")
+	}
+	go server.Close()
+	select {
+	case b := <-c:
+		if b != nil {
+			t.Fatalf("unexpected data %q after close", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket channel not closed")
+	}
+}
+
+func waitTimeout(t *testing.T, wg *sync.WaitGroup, d time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatal("goroutines did not return after close")
+	}
+}
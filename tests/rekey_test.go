@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+// rekeyLogger counts the key rotation messages.
+type rekeyLogger struct {
+	mu      sync.Mutex
+	rotated int
+}
+
+func (l *rekeyLogger) Printf(format string, v ...any) {
+	if strings.Contains(format, "key rotated") {
+		l.mu.Lock()
+		l.rotated++
+		l.mu.Unlock()
+	}
+}
+
+func TestRekey(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	// Rotate the key for every chunk, so the epoch wraps around.
+	log := &rekeyLogger{}
+	cfg := r.Config()
+	cfg.RekeyBytes = 1
+	cfg.Logger = log
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "rekey", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := qsocket.NewSocketWithConfig(qsocket.Server, "rekey", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, true); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	const chunks = 600
+	msg := bytes.Repeat([]byte("rekey"), 200)
+	go func() {
+		for i := 0; i < chunks; i++ {
+			client.Write(msg)
+		}
+	}()
+	buf := make([]byte, len(msg))
+	for i := 0; i < chunks; i++ {
+		if _, err := io.ReadFull(server, buf); err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatalf("chunk %d: corrupted data", i)
+		}
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	// Both the sender and the receiver rotate their keys.
+	if log.rotated < 2*(chunks-1) {
+		t.Errorf("got %d key rotations, want at least %d", log.rotated, 2*(chunks-1))
+	}
+}
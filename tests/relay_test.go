@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+func TestRelayPairing(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	// E2E does not depend on TLS, plain TCP sessions are encrypted too.
+	client, server, err := r.DialPair(context.Background(), "relay-pairing", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+	if client.CipherSuite() == "" || client.CipherSuite() != server.CipherSuite() {
+		t.Errorf("E2E not negotiated, client %q, server %q", client.CipherSuite(), server.CipherSuite())
+	}
+
+	msg := []byte("hello over the relay")
+	if _, err := client.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(msg) {
+		t.Errorf("server read %q, want %q", buf[:n], msg)
+	}
+}
+
+func TestRelayPeerNotFound(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	client, _, err := r.NewPair("relay-no-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Dial(false)
+	if !errors.Is(err, qsocket.ErrPeerNotFound) {
+		t.Fatalf("got %v, want %v", err, qsocket.ErrPeerNotFound)
+	}
+	var re *qsocket.RelayError
+	if !errors.As(err, &re) || !re.Retryable {
+		t.Errorf("expected a retryable relay error, got %#v", err)
+	}
+}
+
+func TestRelayServerCollision(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	_, first, err := r.NewPair("relay-collision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() { firstErr <- first.DialContext(ctx, false) }()
+	defer func() {
+		cancel()
+		<-firstErr
+	}()
+
+	_, second, err := r.NewPair("relay-collision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		err = second.DialContext(ctx, false)
+		cancel()
+		if errors.Is(err, qsocket.ErrServerCollision) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v, want %v", err, qsocket.ErrServerCollision)
+		}
+	}
+}
+
+func TestRelayUpgradeRequired(t *testing.T) {
+	r := qsockettest.NewUnstartedRelay()
+	r.RequireUpgrade = func(r *http.Request) string { return "Please upgrade." }
+	r.Start()
+	defer r.Close()
+
+	client, _, err := r.NewPair("relay-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Dial(false)
+	if !errors.Is(err, qsocket.ErrUpgradeRequired) {
+		t.Fatalf("got %v, want %v", err, qsocket.ErrUpgradeRequired)
+	}
+	var re *qsocket.RelayError
+	if !errors.As(err, &re) {
+		t.Fatalf("got %T, want *qsocket.RelayError", err)
+	}
+	if re.StatusCode != http.StatusUpgradeRequired || re.Message != "Please upgrade." || re.Retryable {
+		t.Errorf("unexpected relay error %+v", re)
+	}
+}
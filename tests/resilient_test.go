@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+func TestResilientSocketResume(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	cfg := r.Config()
+	cfg.Reconnect = qsocket.DefaultReconnectConfig()
+	cfg.Reconnect.MinBackoff = 10 * time.Millisecond
+	cfg.Reconnect.Timeout = 10 * time.Second
+	client, err := qsocket.NewResilientSocket(qsocket.Client, "resilient-resume", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := qsocket.NewResilientSocket(qsocket.Server, "resilient-resume", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srvErr := make(chan error, 1)
+	go func() { srvErr <- server.Dial() }()
+	for {
+		err = client.DialContext(context.Background())
+		if !errors.Is(err, qsocket.ErrPeerNotFound) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-srvErr; err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, 8<<20)
+	rand.Read(payload)
+	go func() {
+		client.Write(payload)
+		client.Close()
+	}()
+
+	got := make([]byte, 0, len(payload))
+	buf := make([]byte, 64*1024)
+	dropped := false
+	for {
+		n, err := server.Read(buf)
+		got = append(got, buf[:n]...)
+		if !dropped && len(got) > len(payload)/4 {
+			// Drop all relay connections in the middle of the transfer.
+			r.CloseConns()
+			dropped = true
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Close()
+
+	if !bytes.Equal(got, payload) {
+		t.Errorf("received %d bytes, want %d identical bytes", len(got), len(payload))
+	}
+	if client.Reconnects() == 0 || server.Reconnects() == 0 {
+		t.Errorf("expected reconnects, got client=%d server=%d", client.Reconnects(), server.Reconnects())
+	}
+}
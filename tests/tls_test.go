@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+func newMTLSRelay(t *testing.T) (*qsockettest.Relay, tls.Certificate) {
+	cert, err := qsockettest.NewClientCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	r := qsockettest.NewUnstartedRelay()
+	r.TLSConfig = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	return r.Start(), cert
+}
+
+func TestClientCertificate(t *testing.T) {
+	r, cert := newMTLSRelay(t)
+	defer r.Close()
+
+	// The server loads the certificate from PEM files, the client sets it directly.
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	keyDer, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := r.Config()
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "mtls", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetClientCertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+	cfg.ClientCertFile = certFile
+	cfg.ClientKeyFile = keyFile
+	server, err := qsocket.NewSocketWithConfig(qsocket.Server, "mtls", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = qsockettest.DialSockets(ctx, client, server, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	state, ok := client.TLSConnectionState()
+	if !ok || !state.HandshakeComplete {
+		t.Fatalf("unexpected TLS connection state %+v", state)
+	}
+	if state.ServerName != qsockettest.ServerName {
+		t.Errorf("got server name %q, want %q", state.ServerName, qsockettest.ServerName)
+	}
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	r, _ := newMTLSRelay(t)
+	defer r.Close()
+
+	client, _, err := r.NewPair("mtls-required")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.DialContext(ctx, true); err == nil {
+		client.Close()
+		t.Fatal("dial succeeded without a client certificate")
+	}
+	if _, ok := client.TLSConnectionState(); ok {
+		t.Error("closed socket reported a TLS connection state")
+	}
+}
+
+func TestCAVerification(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	cfg := r.Config()
+	cfg.CertFingerprint = ""
+	cfg.TLSVerify = qsocket.TLS_VERIFY_CA
+	cfg.TLSConfig = &tls.Config{
+		RootCAs:    r.CertPool(),
+		MinVersion: tls.VersionTLS13,
+	}
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "ca-verify", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server loads the relay certificate from a root CA file.
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: r.Certificate.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.TLSConfig = nil
+	cfg.RootCAFile = caFile
+	server, err := qsocket.NewSocketWithConfig(qsocket.Server, "ca-verify", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = qsockettest.DialSockets(ctx, client, server, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	state, _ := client.TLSConnectionState()
+	if state.Version != tls.VersionTLS13 {
+		t.Errorf("got TLS version %x, want %x", state.Version, tls.VersionTLS13)
+	}
+	if len(state.VerifiedChains) == 0 {
+		t.Error("gate certificate chain is not verified")
+	}
+}
+
+func TestCAVerificationUntrusted(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	cfg := r.Config()
+	cfg.CertFingerprint = ""
+	cfg.TLSVerify = qsocket.TLS_VERIFY_CA
+	client, _, err := r.NewPairWithConfig("ca-untrusted", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Dial(true)
+	var uae x509.UnknownAuthorityError
+	if !errors.As(err, &uae) {
+		t.Errorf("got %v, want %T", err, uae)
+	}
+}
+
+func TestDefaultVerificationWithoutFingerprint(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	// Without a fingerprint the default mode verifies the certificate chain,
+	// the self signed relay certificate is only accepted in the none mode.
+	for _, tc := range []struct {
+		mode    string
+		trusted bool
+	}{
+		{qsocket.TLS_VERIFY_DEFAULT, false},
+		{qsocket.TLS_VERIFY_NONE, true},
+	} {
+		cfg := r.Config()
+		cfg.CertFingerprint = ""
+		cfg.TLSVerify = tc.mode
+		client, _, err := r.NewPairWithConfig("default-verify", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Dial(true)
+		var uae x509.UnknownAuthorityError
+		if tc.trusted && !errors.Is(err, qsocket.ErrPeerNotFound) {
+			t.Errorf("%q: got %v, want %v", tc.mode, err, qsocket.ErrPeerNotFound)
+		}
+		if !tc.trusted && !errors.As(err, &uae) {
+			t.Errorf("%q: got %v, want %T", tc.mode, err, uae)
+		}
+		client.Close()
+	}
+}
+
+func TestInvalidTLSConfig(t *testing.T) {
+	for _, tc := range []struct {
+		mutate func(*qsocket.Config)
+		err    error
+	}{
+		{func(c *qsocket.Config) { c.ClientCertFile = "client.crt" }, qsocket.ErrInvalidClientCertificate},
+		{func(c *qsocket.Config) { c.TLSVerify = "bogus" }, qsocket.ErrInvalidTLSVerifyMode},
+		{func(c *qsocket.Config) { c.TLSVerify = qsocket.TLS_VERIFY_PIN }, qsocket.ErrMissingCertFingerprint},
+	} {
+		cfg := qsocket.DefaultConfig()
+		tc.mutate(cfg)
+		if err := cfg.Validate(); err != tc.err {
+			t.Errorf("got %v, want %v", err, tc.err)
+		}
+	}
+}
+
+// newChainRelay starts a relay presenting a leaf certificate issued by an
+// intermediate CA, and returns it with the root, intermediate and leaf certificates.
+func newChainRelay(t *testing.T) (r *qsockettest.Relay, chain []*x509.Certificate) {
+	issue := func(template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.SerialNumber = big.NewInt(int64(len(chain) + 1))
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, cert)
+		return cert, key
+	}
+	ca := func(name string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:               pkix.Name{CommonName: name},
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+	}
+	root, rootKey := issue(ca("QSocket Test Root"), nil, nil)
+	intermediate, intermediateKey := issue(ca("QSocket Test Intermediate"), root, rootKey)
+	leaf, leafKey := issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: qsockettest.ServerName},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{qsockettest.ServerName},
+	}, intermediate, intermediateKey)
+
+	r = qsockettest.NewUnstartedRelay()
+	r.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{leaf.Raw, intermediate.Raw},
+			PrivateKey:  leafKey,
+			Leaf:        leaf,
+		}},
+	}
+	return r.Start(), chain
+}
+
+func TestCAVerificationWithFingerprint(t *testing.T) {
+	r, chain := newChainRelay(t)
+	defer r.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(chain[0])
+	fingerprint := func(cert *x509.Certificate) string {
+		h := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(h[:])
+	}
+	other := qsockettest.NewRelay()
+	defer other.Close()
+
+	for _, tc := range []struct {
+		name, mode, fingerprint string
+		err                     error
+	}{
+		{"ca leaf", qsocket.TLS_VERIFY_CA, fingerprint(chain[2]), nil},
+		{"ca intermediate", qsocket.TLS_VERIFY_CA, fingerprint(chain[1]), nil},
+		{"ca root", qsocket.TLS_VERIFY_CA, fingerprint(chain[0]), nil},
+		{"ca mismatch", qsocket.TLS_VERIFY_CA, other.CertFingerprint, qsocket.ErrUntrustedCert},
+		{"pin leaf", qsocket.TLS_VERIFY_PIN, fingerprint(chain[2]), nil},
+		// Without chain verification only the gate certificate can be pinned.
+		{"pin intermediate", qsocket.TLS_VERIFY_PIN, fingerprint(chain[1]), qsocket.ErrUntrustedCert},
+	} {
+		cfg := r.Config()
+		cfg.TLSVerify = tc.mode
+		cfg.CertFingerprint = tc.fingerprint
+		cfg.TLSConfig = &tls.Config{RootCAs: roots}
+		client, server, err := r.NewPairWithConfig("ca-fingerprint", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = qsockettest.DialSockets(ctx, client, server, true)
+		cancel()
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/qsocket/qsocket-go"
+	"github.com/qsocket/qsocket-go/internal/websocket"
+	"github.com/qsocket/qsocket-go/qsockettest"
+)
+
+func TestWebSocketFraming(t *testing.T) {
+	r := qsockettest.NewRelay()
+	defer r.Close()
+
+	// Framed client with a raw server, the relay translates between them.
+	cfg := r.Config()
+	cfg.WebSocket = true
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "websocket-framing", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := qsocket.NewSocketWithConfig(qsocket.Server, "websocket-framing", r.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qsockettest.DialSockets(context.Background(), client, server, true); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	msg := bytes.Repeat([]byte("qsocket"), 100000)
+	go client.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Error("server received corrupted data")
+	}
+
+	go server.Write(msg[:1024])
+	if _, err := io.ReadFull(client, buf[:1024]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:1024], msg[:1024]) {
+		t.Error("client received corrupted data")
+	}
+}
+
+// dialFakeWebsocketRelay dials a framed client to a relay that answers the
+// protocol switch with the headers returned by the given function.
+func dialFakeWebsocketRelay(t *testing.T, headers func(key string) string) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			headers(req.Header.Get("Sec-WebSocket-Key")) +
+			"\r\n"))
+		io.Copy(io.Discard, conn)
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	cfg := qsocket.DefaultConfig()
+	cfg.Gate = "127.0.0.1"
+	cfg.Port = p
+	cfg.E2E = false
+	cfg.WebSocket = true
+	client, err := qsocket.NewSocketWithConfig(qsocket.Client, "websocket-relay", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	return client.Dial(false)
+}
+
+func TestWebSocketInvalidAccept(t *testing.T) {
+	err := dialFakeWebsocketRelay(t, func(key string) string {
+		return "Sec-WebSocket-Accept: " + qsocket.WebsocketAcceptKey(key+"x") + "\r\n" +
+			"Sec-WebSocket-Protocol: " + qsocket.WEBSOCKET_PROTOCOL + "\r\n"
+	})
+	if !errors.Is(err, qsocket.ErrInvalidWebsocketAccept) {
+		t.Errorf("got %v, want %v", err, qsocket.ErrInvalidWebsocketAccept)
+	}
+
+	err = dialFakeWebsocketRelay(t, func(key string) string {
+		return "Sec-WebSocket-Protocol: " + qsocket.WEBSOCKET_PROTOCOL + "\r\n"
+	})
+	if !errors.Is(err, qsocket.ErrInvalidWebsocketAccept) {
+		t.Errorf("missing accept: got %v, want %v", err, qsocket.ErrInvalidWebsocketAccept)
+	}
+}
+
+func TestWebSocketUnsupported(t *testing.T) {
+	err := dialFakeWebsocketRelay(t, func(key string) string {
+		return "Sec-WebSocket-Accept: " + qsocket.WebsocketAcceptKey(key) + "\r\n"
+	})
+	if !errors.Is(err, qsocket.ErrWebsocketUnsupported) {
+		t.Errorf("got %v, want %v", err, qsocket.ErrWebsocketUnsupported)
+	}
+}
+
+// readFrame reads a single unfragmented frame with a short payload.
+func readFrame(r io.Reader) (opcode byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	var key [4]byte
+	if hdr[1]&0x80 != 0 {
+		if _, err = io.ReadFull(r, key[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload = make([]byte, hdr[1]&0x7F)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= key[i&3]
+	}
+	return hdr[0] & 0x0F, payload, nil
+}
+
+func TestWebSocketControlFrames(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := websocket.NewConn(c1, true, 0)
+	defer conn.Close()
+
+	readErr := make(chan error, 1)
+	data := make(chan []byte, 1)
+	go func() {
+		buf, err := io.ReadAll(conn)
+		data <- buf
+		readErr <- err
+	}()
+
+	// Pings are answered with the same payload and pongs are ignored.
+	c2.Write([]byte{0x89, 4, 'p', 'i', 'n', 'g'})
+	opcode, payload, err := readFrame(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != 0xA || string(payload) != "ping" {
+		t.Errorf("got opcode %#x payload %q, want pong %q", opcode, payload, "ping")
+	}
+	c2.Write([]byte{0x8A, 0})
+	c2.Write([]byte{0x82, 4, 'd', 'a', 't', 'a'})
+
+	// The close frame is echoed and ends the stream.
+	c2.Write([]byte{0x88, 2, 0x03, 0xE8})
+	opcode, payload, err = readFrame(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != 0x8 || !bytes.Equal(payload, []byte{0x03, 0xE8}) {
+		t.Errorf("got opcode %#x payload %x, want close 03e8", opcode, payload)
+	}
+	if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+	if buf := <-data; string(buf) != "data" {
+		t.Errorf("read %q, want %q", buf, "data")
+	}
+
+	// Client pings are masked.
+	go conn.Ping([]byte("keepalive"))
+	opcode, payload, err = readFrame(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != 0x9 || string(payload) != "keepalive" {
+		t.Errorf("got opcode %#x payload %q, want ping %q", opcode, payload, "keepalive")
+	}
+}
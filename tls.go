@@ -0,0 +1,140 @@
+package qsocket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+const (
+	// TLS_VERIFY_DEFAULT pins the gate certificate if a fingerprint is set,
+	// otherwise it verifies the certificate chain like TLS_VERIFY_CA.
+	TLS_VERIFY_DEFAULT = ""
+	// TLS_VERIFY_PIN requires the gate certificate to match the configured fingerprint.
+	TLS_VERIFY_PIN = "pin"
+	// TLS_VERIFY_CA verifies the gate certificate chain and host name against the
+	// root CA pool. If a fingerprint is set, the gate certificate or one of the
+	// intermediate or root certificates of the verified chain must also match it.
+	TLS_VERIFY_CA = "ca"
+	// TLS_VERIFY_NONE accepts any gate certificate.
+	TLS_VERIFY_NONE = "none"
+)
+
+var (
+	ErrInvalidClientCertificate = errors.New("Client certificate and key files must be set together.")
+	ErrInvalidTLSVerifyMode     = errors.New("Invalid TLS verification mode.")
+	ErrMissingCertFingerprint   = errors.New("TLS certificate pinning requires a fingerprint.")
+	ErrInvalidRootCAFile        = errors.New("No certificates found in root CA file.")
+)
+
+// SetTLSConfig sets the base TLS config of the gate connection, e.g. for ALPN,
+// TLS versions or cipher suites. Certificate verification is still controlled
+// by the TLSVerify mode of the socket config.
+func (qs *QSocket) SetTLSConfig(c *tls.Config) error {
+	if !qs.IsClosed() {
+		return ErrSocketInUse
+	}
+
+	qs.config.TLSConfig = c.Clone()
+	return nil
+}
+
+// SetClientCertificate sets the certificate presented to gates that request
+// client authentication (mTLS), replacing the configured client certificates.
+func (qs *QSocket) SetClientCertificate(cert tls.Certificate) error {
+	if !qs.IsClosed() {
+		return ErrSocketInUse
+	}
+
+	qs.config.ClientCertificates = []tls.Certificate{cert}
+	return nil
+}
+
+// SetClientCertificateFile loads a PEM encoded certificate and key pair from
+// the given files and sets it as the client certificate.
+func (qs *QSocket) SetClientCertificateFile(certFile, keyFile string) error {
+	if !qs.IsClosed() {
+		return ErrSocketInUse
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	qs.config.ClientCertificates = []tls.Certificate{cert}
+	qs.config.ClientCertFile = certFile
+	qs.config.ClientKeyFile = keyFile
+	return nil
+}
+
+// SetRootCAFile loads the PEM encoded root CA certificates used by
+// the TLS_VERIFY_CA mode from the given file.
+func (qs *QSocket) SetRootCAFile(caFile string) error {
+	if !qs.IsClosed() {
+		return ErrSocketInUse
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return ErrInvalidRootCAFile
+	}
+	qs.rootCAs = pool
+	qs.config.RootCAFile = caFile
+	return nil
+}
+
+// TLSConnectionState returns the state of the TLS connection to the gate.
+// The second return value is false if the socket is not dialed over TLS.
+func (qs *QSocket) TLSConnectionState() (tls.ConnectionState, bool) {
+	qs.mu.RLock()
+	tlsConn := qs.tlsConn
+	qs.mu.RUnlock()
+	if tlsConn == nil {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// tlsConfig returns the TLS config for the gate connection.
+func (qs *QSocket) tlsConfig() *tls.Config {
+	c := &tls.Config{}
+	if qs.config.TLSConfig != nil {
+		c = qs.config.TLSConfig.Clone()
+	}
+	if c.ServerName == "" {
+		c.ServerName = qs.config.serverName()
+	}
+	if qs.config.ClientCertificates != nil {
+		c.Certificates = qs.config.ClientCertificates
+	}
+	if qs.config.GetClientCertificate != nil {
+		c.GetClientCertificate = qs.config.GetClientCertificate
+	}
+
+	verifyChain := qs.config.TLSVerify == TLS_VERIFY_CA ||
+		(qs.config.TLSVerify == TLS_VERIFY_DEFAULT && qs.certHash == nil)
+	if verifyChain {
+		c.InsecureSkipVerify = false
+		if qs.rootCAs != nil {
+			c.RootCAs = qs.rootCAs
+		}
+	} else {
+		// Pinning is done by VerifyTlsCertificate after the handshake.
+		c.InsecureSkipVerify = true
+	}
+	return c
+}
+
+func validTLSVerifyMode(mode string) bool {
+	switch mode {
+	case TLS_VERIFY_DEFAULT, TLS_VERIFY_PIN, TLS_VERIFY_CA, TLS_VERIFY_NONE:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,116 @@
+package qsocket
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// TOR_SOCKS_ADDR is the default SOCKS address of the Tor daemon.
+	TOR_SOCKS_ADDR = "127.0.0.1:9050"
+	// TOR_BROWSER_SOCKS_ADDR is the default SOCKS address of the Tor Browser.
+	TOR_BROWSER_SOCKS_ADDR = "127.0.0.1:9150"
+	// torUnixPrefix marks Unix domain socket SOCKS addresses, like the Tor `SocksPort` option.
+	torUnixPrefix = "unix:"
+)
+
+var ErrInvalidTorConfig = errors.New("Invalid Tor SOCKS address.")
+
+// TorConfig configures reaching the gate over the Tor network. The socket
+// dials the onion address of the gate (Config.TorGate) through the Tor SOCKS port,
+// the SOCKS port itself is reached through Config.Proxy if it is set.
+type TorConfig struct {
+	// SocksAddr is the address of the Tor SOCKS port, e.g. TOR_SOCKS_ADDR or
+	// TOR_BROWSER_SOCKS_ADDR, or "unix:/path/to/socket" for a Unix domain socket.
+	// Empty means TOR_SOCKS_ADDR.
+	SocksAddr string `json:"socks_addr"`
+	// Isolation is sent as the SOCKS credentials, Tor only shares circuits
+	// between streams with the same credentials. (IsolateSOCKSAuth)
+	Isolation string `json:"isolation"`
+	// IsolateSocket uses random SOCKS credentials for each socket, so that
+	// every socket is carried over its own circuit. It overrides Isolation.
+	IsolateSocket bool `json:"isolate_socket"`
+}
+
+// DefaultTorConfig returns the default Tor configuration for the local Tor daemon.
+func DefaultTorConfig() *TorConfig {
+	return &TorConfig{SocksAddr: TOR_SOCKS_ADDR}
+}
+
+// Validate checks whether the Tor config values are valid.
+func (c *TorConfig) Validate() error {
+	network, addr := c.socksAddr()
+	if network == "unix" {
+		if addr == "" {
+			return ErrInvalidTorConfig
+		}
+		return nil
+	}
+	_, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ErrInvalidTorConfig
+	}
+	return nil
+}
+
+// socksAddr returns the network and the address of the Tor SOCKS port.
+func (c *TorConfig) socksAddr() (network, addr string) {
+	if c.SocksAddr == "" {
+		return "tcp", TOR_SOCKS_ADDR
+	}
+	if strings.HasPrefix(c.SocksAddr, torUnixPrefix) {
+		return "unix", strings.TrimPrefix(c.SocksAddr, torUnixPrefix)
+	}
+	return "tcp", c.SocksAddr
+}
+
+// SetTor enables reaching the gate over Tor with the given config, nil disables Tor.
+func (qs *QSocket) SetTor(tor *TorConfig) error {
+	if !qs.IsClosed() {
+		return ErrSocketInUse
+	}
+	if tor == nil {
+		qs.config.Tor = nil
+		qs.torAuth = nil
+		return nil
+	}
+
+	err := tor.Validate()
+	if err != nil {
+		return err
+	}
+	tc := *tor
+	qs.config.Tor = &tc
+	qs.torAuth = nil
+	switch {
+	case tc.IsolateSocket:
+		// Tor requires non-empty credentials, the values are only compared.
+		qs.torAuth = &proxy.Auth{
+			User:     RandomString(URI_CHARSET, 16),
+			Password: RandomString(URI_CHARSET, 16),
+		}
+	case tc.Isolation != "":
+		qs.torAuth = &proxy.Auth{User: tc.Isolation, Password: tc.Isolation}
+	}
+	return nil
+}
+
+// torDialer returns the dialer of the Tor SOCKS port, which is
+// reached through the configured proxy if there is one.
+func (qs *QSocket) torDialer() (proxy.Dialer, error) {
+	network, addr := qs.config.Tor.socksAddr()
+	var forward proxy.Dialer = qs.netDialer()
+	if network == "tcp" {
+		upstream, err := qs.upstreamDialer(addr)
+		if err != nil {
+			return nil, err
+		}
+		if upstream != nil {
+			forward = upstream
+		}
+	}
+	return proxy.SOCKS5(network, addr, qs.torAuth, forward)
+}
@@ -0,0 +1,81 @@
+package qsocket
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// UID derivation versions.
+const (
+	// UID_V1 is the legacy MD5 UID derivation, only for pairing through old relays
+	// that require it. Both peers must use this version of the library, the E2E
+	// handshake is not compatible with peers that predate UID_V2.
+	UID_V1 = 1
+	// UID_V2 derives the UID and the PAKE secret with Argon2id.
+	UID_V2 = 2
+	// DefaultUIDVersion is the UID derivation version used by default.
+	DefaultUIDVersion = UID_V2
+)
+
+// Argon2id parameters of the UID_V2 derivation, the OWASP recommended minimum
+// keeps dialing fast enough on small devices. Changing them requires a new UID version.
+const (
+	uidArgonTime    = 1
+	uidArgonMemory  = 46 * 1024 // KiB
+	uidArgonThreads = 1
+	uidArgonKeyLen  = 32
+)
+
+// Domain separation labels of the UID_V2 derivation.
+const (
+	labelUIDSalt    = "qsocket uid v2 salt"
+	labelUID        = "qsocket uid v2 rendezvous"
+	labelPakeSecret = "qsocket uid v2 pake"
+	labelAddr       = "qsocket-addr:"
+)
+
+// secretKeys holds the values derived from the connection secret.
+type secretKeys struct {
+	// uid is the rendezvous ID sent to the relay in the `Sec-WebSocket-Key` header.
+	uid [16]byte
+	// pakeSecret is the input of the E2E key exchange, it is independent of the uid.
+	pakeSecret []byte
+	// addrID is the short ID used in the peer addresses.
+	addrID string
+}
+
+// deriveSecretKeys derives the relay UID, PAKE secret and address ID from the secret.
+// UID_V2 uses the slow Argon2id KDF, so that the UID seen by the relay (or anyone
+// watching a plain TCP connection) can not be used for cheap offline dictionary attacks.
+func deriveSecretKeys(secret string, version int) *secretKeys {
+	keys := &secretKeys{}
+	if version == UID_V1 {
+		keys.uid = md5.Sum([]byte(secret))
+		keys.pakeSecret = []byte(secret)
+	} else {
+		salt := sha256.Sum256([]byte(labelUIDSalt))
+		master := argon2.IDKey([]byte(secret), salt[:], uidArgonTime, uidArgonMemory, uidArgonThreads, uidArgonKeyLen)
+		// HKDF-Expand of up to 255*32 bytes can not fail, the errors of both
+		// expansions are ignored.
+		uid, _ := expandLabel(master, labelUID, len(keys.uid))
+		copy(keys.uid[:], uid)
+		keys.pakeSecret, _ = expandLabel(master, labelPakeSecret, 32)
+		zero(master)
+	}
+	h := sha256.Sum256(append([]byte(labelAddr), keys.uid[:]...))
+	keys.addrID = hex.EncodeToString(h[:8])
+	return keys
+}
+
+// secretKeys returns the values derived from the secret, they are derived once per socket.
+func (qs *QSocket) secretKeys() *secretKeys {
+	qs.keysOnce.Do(func() {
+		if qs.keys == nil {
+			qs.keys = deriveSecretKeys(qs.secret, qs.config.uidVersion())
+		}
+	})
+	return qs.keys
+}
@@ -1,10 +1,15 @@
 package qsocket
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"net"
 	"runtime"
 	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
 )
 
 const UserAgentTemplate = "Mozilla/5.0 (%s; %s) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/%s Safari/537.3"
@@ -47,3 +52,64 @@ func CalcChecksum(data []byte, base byte) byte {
 	}
 	return byte(checksum)
 }
+
+// dialProxyContext dials the given address through the proxy dialer,
+// honoring the context when the dialer supports it.
+func dialProxyContext(ctx context.Context, d proxy.Dialer, network, address string) (net.Conn, error) {
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, address)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		conn, err := d.Dial(network, address)
+		done <- dialResult{conn, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		go func() {
+			// Close the late connection, if any.
+			if res := <-done; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case res := <-done:
+		return res.conn, res.err
+	}
+}
+
+// watchContext interrupts all pending and future I/O on the given connection
+// once the context is done. The returned function stops watching the context,
+// it must be called before the connection is handed over to the caller.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Setting a deadline in the past unblocks any pending Read/Write calls.
+			conn.SetDeadline(time.Unix(1, 0))
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+
+	return func() {
+		close(done)
+		if <-interrupted {
+			// The context fired after the last I/O call, clear the deadline.
+			conn.SetDeadline(time.Time{})
+		}
+	}
+}